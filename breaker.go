@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+	"github.com/ConnorsApps/unifi-backup/pkg/config"
+	"github.com/ConnorsApps/unifi-backup/pkg/unifi"
+)
+
+// controllerBreaker is the circuit breaker of the configured controller,
+// persisted in the breaker state file between runs
+type controllerBreaker struct {
+	backoff.Breaker
+	path string
+	key  string
+}
+
+// breakerKey identifies the controller in the breaker state file
+func breakerKey(cfg *config.Config) string {
+	return strings.TrimSuffix(cfg.UniFi.URL, "/")
+}
+
+// openControllerBreaker loads the breaker state of the configured
+// controller. It returns nil when the breaker is disabled.
+func openControllerBreaker(cfg *config.Config) (*controllerBreaker, error) {
+	if cfg.Breaker.Threshold <= 0 {
+		return nil, nil
+	}
+	coolDown, err := time.ParseDuration(cfg.Breaker.CoolDown)
+	if err != nil {
+		return nil, fmt.Errorf("invalid breaker cool-down: %w", err)
+	}
+	states, err := backoff.LoadBreakerStates(cfg.Breaker.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key := breakerKey(cfg)
+	return &controllerBreaker{
+		Breaker: backoff.Breaker{
+			Threshold: cfg.Breaker.Threshold,
+			CoolDown:  coolDown,
+			State:     states[key],
+		},
+		path: cfg.Breaker.StateFile,
+		key:  key,
+	}, nil
+}
+
+// allow reports whether this run may contact the controller. While the
+// breaker is open the run is skipped; once the cool-down has passed the
+// controller is probed with a single request that does not log in.
+func (b *controllerBreaker) allow(ctx context.Context, client *unifi.Client) bool {
+	switch b.Status() {
+	case backoff.BreakerOpen:
+		slog.Warn("Controller circuit breaker is open, skipping run",
+			"open_until", b.State.OpenUntil,
+			"failures", b.State.Failures,
+			"last_error", b.State.LastError,
+		)
+		return false
+	case backoff.BreakerHalfOpen:
+		slog.Info("Controller circuit breaker cool-down is over, probing controller", "failures", b.State.Failures)
+		probeCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		if err := client.Ping(probeCtx); err != nil {
+			slog.Error("Controller probe failed", "error", err)
+			b.failure(fmt.Errorf("probe: %w", err))
+			return false
+		}
+	}
+	return true
+}
+
+// failure records a run that could not complete against the controller.
+// It does nothing when the breaker is disabled, the run was interrupted or
+// err is permanent, such as a preflight or credential problem: those are
+// fixed in the configuration, not by waiting for the controller.
+func (b *controllerBreaker) failure(err error) {
+	if b == nil || !backoff.IsRetryable(err) {
+		return
+	}
+	b.RecordFailure(err)
+	if b.Status() == backoff.BreakerOpen {
+		slog.Warn("Controller circuit breaker opened",
+			"failures", b.State.Failures,
+			"open_until", b.State.OpenUntil,
+		)
+	}
+	b.save()
+}
+
+// success closes the breaker after the controller delivered a backup. It
+// does nothing when the breaker is disabled.
+func (b *controllerBreaker) success() {
+	if b == nil {
+		return
+	}
+	if b.State.Failures > 0 {
+		slog.Info("Controller circuit breaker closed", "previous_failures", b.State.Failures)
+	}
+	b.RecordSuccess()
+	b.save()
+}
+
+// save writes the breaker state back to the state file. Other controllers'
+// entries are reloaded first so they are kept.
+func (b *controllerBreaker) save() {
+	states, err := backoff.LoadBreakerStates(b.path)
+	if err != nil {
+		slog.Warn("Failed to update circuit breaker state", "path", b.path, "error", err)
+		return
+	}
+	states[b.key] = b.State
+	if err := backoff.SaveBreakerStates(b.path, states); err != nil {
+		slog.Warn("Failed to update circuit breaker state", "path", b.path, "error", err)
+	}
+}
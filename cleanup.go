@@ -2,73 +2,165 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sort"
+	"strings"
 	"time"
 
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
 	"github.com/ConnorsApps/unifi-backup/pkg/storage"
 )
 
 // backupInfo holds information about a backup file
 type backupInfo struct {
-	filename  string
-	timestamp time.Time
+	filename    string
+	timestamp   time.Time
+	hasManifest bool
+	// verified is set when the backup passed its last restore test
+	verified bool
 }
 
-// cleanupOldBackups removes old backups keeping only the last n backups
-func cleanupOldBackups(ctx context.Context, store storage.ObjectStore, keepLast int) error {
+// cleanupOldBackups removes old backups keeping only the last n backups.
+//
+// Backups are read from the store's catalog while it is younger than
+// catalogMaxAge, and from a full listing otherwise. Keys are parsed with
+// layout, and backups whose key or manifest records a different controller
+// or site than current are left alone so several controllers can share a
+// store. Manifests are deleted together with their backup, and orphaned
+// manifests of this controller and site are removed. Each backup deletion
+// is retried according to deletePolicy.
+func cleanupOldBackups(ctx context.Context, store storage.ObjectStore, layout *storage.KeyLayout, current storage.KeyData, keepLast int, catalogMaxAge time.Duration, deletePolicy backoff.Policy) error {
 	slog.Info("Checking for old backups to cleanup", "keep_last", keepLast)
 
-	// List all backup files
-	files, err := store.List(ctx)
+	catalog, err := storage.LoadCatalog(ctx, store, catalogMaxAge)
 	if err != nil {
 		return fmt.Errorf("failed to list backup files: %w", err)
 	}
 
-	if len(files) <= keepLast {
-		slog.Info("No cleanup needed", "backup_count", len(files), "keep_last", keepLast)
-		return nil
-	}
+	backups := retentionBackups(catalog, layout, current)
 
-	// Parse timestamps from filenames
-	var backups []backupInfo
-	for _, filename := range files {
-		timestamp, err := storage.ParseBackupFilename(filename)
-		if err != nil {
-			slog.Debug("Skipping file with unparseable format", "filename", filename, "error", err)
+	// Only known after a full listing
+	for _, manifestKey := range catalog.OrphanedManifests {
+		data, err := layout.Parse(strings.TrimSuffix(manifestKey, storage.ManifestSuffix))
+		if err != nil || !data.SameSource(current) {
 			continue
 		}
-		backups = append(backups, backupInfo{
-			filename:  filename,
-			timestamp: timestamp,
-		})
+		slog.Info("Deleting orphaned manifest", "filename", manifestKey)
+		if err := store.Delete(ctx, manifestKey); err != nil {
+			slog.Warn("failed to delete orphaned manifest", "filename", manifestKey, "error", err)
+		}
 	}
 
-	// Sort by timestamp (newest first)
-	sort.Slice(backups, func(i, j int) bool {
-		return backups[i].timestamp.After(backups[j].timestamp)
-	})
+	if len(backups) <= keepLast {
+		slog.Info("No cleanup needed", "backup_count", len(backups), "keep_last", keepLast)
+		return nil
+	}
 
 	// Delete backups beyond the keepLast count
+	toDelete := retentionDeletions(backups, keepLast)
 	deletedCount := 0
 	failedCount := 0
-	for i := keepLast; i < len(backups); i++ {
-		backup := backups[i]
+	var deleted []string
+	for _, backup := range toDelete {
 		slog.Info("Deleting old backup", "filename", backup.filename, "timestamp", backup.timestamp)
-		if err := store.Delete(ctx, backup.filename); err != nil {
+		err := deletePolicy.Retry(ctx, func() error {
+			return store.Delete(ctx, backup.filename)
+		})
+		if err != nil {
 			slog.Warn("failed to delete backup", "filename", backup.filename, "error", err)
 			failedCount++
 			// Continue trying to delete other files even if one fails
-		} else {
-			deletedCount++
+			continue
+		}
+		deletedCount++
+		deleted = append(deleted, backup.filename)
+
+		if backup.hasManifest {
+			manifestKey := storage.ManifestKey(backup.filename)
+			if err := store.Delete(ctx, manifestKey); err != nil && !errors.Is(err, storage.ErrNotExist) {
+				// Removed as an orphan after the next full listing
+				slog.Warn("failed to delete manifest", "filename", manifestKey, "error", err)
+			}
+		}
+	}
+
+	if catalogMaxAge > 0 && len(deleted) > 0 {
+		if err := storage.UpdateCatalog(ctx, store, func(c *storage.Catalog) { c.Remove(deleted...) }); err != nil {
+			slog.Warn("Failed to update catalog", "error", err)
 		}
 	}
 
 	slog.Info("Cleanup completed",
 		"deleted_count", deletedCount,
 		"failed_count", failedCount,
-		"remaining_count", keepLast+failedCount,
+		"remaining_count", len(backups)-deletedCount,
 	)
 	return nil
 }
+
+// retentionBackups returns the backups in catalog that belong to the
+// controller and site described by current, newest first.
+func retentionBackups(catalog *storage.Catalog, layout *storage.KeyLayout, current storage.KeyData) []backupInfo {
+	// Parse timestamps from filenames
+	var backups []backupInfo
+	for _, entry := range catalog.Backups {
+		filename := entry.Key
+		data, err := layout.Parse(filename)
+		if err != nil {
+			slog.Debug("Skipping file with unparseable format", "filename", filename, "error", err)
+			continue
+		}
+
+		backup := backupInfo{filename: filename, timestamp: data.Time}
+		if entry.Manifest != nil {
+			// Prefer the manifest, which records the source even for flat layouts
+			backup.hasManifest = true
+			backup.verified = entry.Manifest.Verified()
+			data = entry.Manifest.KeyData()
+			if !entry.Manifest.CreatedAt.IsZero() {
+				backup.timestamp = entry.Manifest.CreatedAt
+			}
+		}
+
+		if !data.SameSource(current) {
+			slog.Debug("Skipping backup from another controller or site", "filename", filename)
+			continue
+		}
+		backups = append(backups, backup)
+	}
+
+	// Sort by timestamp (newest first)
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].timestamp.After(backups[j].timestamp)
+	})
+	return backups
+}
+
+// retentionDeletions returns the backups to delete when keeping the newest
+// keepLast of backups, which must be sorted newest first. The newest backup
+// that passed a restore test is always kept, so a run of broken backups
+// cannot push the last good one out.
+func retentionDeletions(backups []backupInfo, keepLast int) []backupInfo {
+	if len(backups) <= keepLast {
+		return nil
+	}
+	lastVerified := -1
+	for i, backup := range backups {
+		if backup.verified {
+			lastVerified = i
+			break
+		}
+	}
+
+	var toDelete []backupInfo
+	for i := keepLast; i < len(backups); i++ {
+		if i == lastVerified {
+			slog.Debug("Keeping last verified backup", "filename", backups[i].filename)
+			continue
+		}
+		toDelete = append(toDelete, backups[i])
+	}
+	return toDelete
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/config"
+	"github.com/ConnorsApps/unifi-backup/pkg/storage"
+	"github.com/ConnorsApps/unifi-backup/pkg/unifi"
+)
+
+// Results of a doctor check
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// certificateExpiryWarning is how long before expiry the doctor warns about
+// the controller certificate
+const certificateExpiryWarning = 30 * 24 * time.Hour
+
+// doctorCheck is a single row of the doctor subcommand output
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// runDoctor implements the doctor subcommand, which checks the
+// configuration, the connection to the controller, the account and every
+// storage target step by step without taking a backup
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML or JSON)")
+	format := fs.String("format", "table", "Output format: table or json")
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	cfg.SetupLoggerTo(os.Stderr)
+
+	write, ok := doctorWriters[strings.ToLower(*format)]
+	if !ok {
+		slog.Error("Invalid output format", "format", *format)
+		return 2
+	}
+
+	timeout, _ := time.ParseDuration(cfg.UniFi.Timeout)
+	retryPolicy, err := cfg.RetryPolicy()
+	if err != nil {
+		slog.Error("Invalid retry policy", "error", err)
+		return 1
+	}
+	client, err := newUniFiClient(cfg, timeout, retryPolicy)
+	if err != nil {
+		slog.Error("Failed to create UniFi client", "error", err)
+		return 1
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// Secrets are only a concern when written in the file itself
+	fileCfg, err := config.LoadConfigFile(*configPath)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+
+	checks := configChecks(cfg, fileCfg)
+	connection := connectionChecks(ctx, cfg, client)
+	checks = append(checks, connection...)
+	if failed(connection) {
+		checks = append(checks,
+			doctorCheck{Name: "login", Status: checkSkip},
+			doctorCheck{Name: "role", Status: checkSkip},
+			doctorCheck{Name: "site", Status: checkSkip})
+	} else {
+		checks = append(checks, controllerChecks(ctx, cfg, client)...)
+	}
+	checks = append(checks, storageChecks(ctx, cfg)...)
+
+	if err := write(os.Stdout, checks); err != nil {
+		slog.Error("Failed to write checks", "error", err)
+		return 1
+	}
+	if failed(checks) {
+		return 1
+	}
+	return 0
+}
+
+// failed reports whether any of checks failed
+func failed(checks []doctorCheck) bool {
+	return slices.ContainsFunc(checks, func(check doctorCheck) bool { return check.Status == checkFail })
+}
+
+// configChecks flags settings that work but weaken security. fileCfg holds
+// the settings of the configuration file alone, without the environment.
+func configChecks(cfg, fileCfg *config.Config) []doctorCheck {
+	tlsCheck := doctorCheck{Name: "config: controller tls", Status: checkPass, Detail: "certificate verified against the system roots"}
+	switch {
+	case len(cfg.UniFi.PinnedSHA256) > 0:
+		tlsCheck.Detail = "certificate pinned"
+	case cfg.UniFi.CAFile != "":
+		tlsCheck.Detail = "certificate verified against " + cfg.UniFi.CAFile
+	case cfg.UniFi.InsecureSkipVerify:
+		tlsCheck.Status, tlsCheck.Detail = checkWarn, "insecure_skip_verify disables certificate verification"
+		tlsCheck.Hint = "pin the certificate in unifi.pinnedSHA256 instead; unifi-backup trust prints its fingerprint"
+	}
+	if strings.HasPrefix(strings.ToLower(cfg.UniFi.URL), "http://") {
+		tlsCheck.Status, tlsCheck.Detail = checkWarn, "controller URL uses plain HTTP"
+		tlsCheck.Hint = "use https:// so that the credentials are encrypted"
+	}
+	checks := []doctorCheck{tlsCheck}
+
+	fileURLs := make(map[string]bool)
+	for _, target := range fileCfg.StorageTargets() {
+		fileURLs[target.URL] = true
+	}
+	for _, target := range cfg.StorageTargets() {
+		check := doctorCheck{Name: "config: storage " + target.Name, Status: checkPass}
+		u, err := url.Parse(target.URL)
+		if err != nil {
+			check.Status, check.Detail = checkFail, fmt.Sprintf("invalid URL: %v", err)
+			checks = append(checks, check)
+			continue
+		}
+		var issues, hints []string
+		if _, ok := u.User.Password(); ok && fileURLs[target.URL] {
+			issues = append(issues, fmt.Sprintf("password written in the %s URL in the configuration file", u.Scheme))
+			hints = append(hints, "set the URL from a secret through STORAGE_URL or STORAGE_TARGETS_<n>_URL rather than the config file")
+		}
+		if insecure, _ := strconv.ParseBool(u.Query().Get("insecure_ignore_host_key")); insecure {
+			issues = append(issues, "insecure_ignore_host_key disables host key verification")
+			hints = append(hints, "add the host key to known_hosts instead")
+		}
+		if len(issues) > 0 {
+			check.Status, check.Detail, check.Hint = checkWarn, strings.Join(issues, "; "), strings.Join(hints, "; ")
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// connectionChecks resolves and connects to the controller, or the proxy in
+// front of it, and checks the TLS handshake with the configured trust
+func connectionChecks(ctx context.Context, cfg *config.Config, client *unifi.Client) []doctorCheck {
+	dns := doctorCheck{Name: "dns", Status: checkSkip}
+	tcp := doctorCheck{Name: "tcp", Status: checkSkip}
+	tlsCheck := doctorCheck{Name: "tls", Status: checkSkip}
+
+	u, err := url.Parse(cfg.UniFi.URL)
+	if err != nil {
+		dns.Status, dns.Detail = checkFail, fmt.Sprintf("invalid controller URL: %v", err)
+		return []doctorCheck{dns, tcp, tlsCheck}
+	}
+	addr, via := controllerAddr(u), ""
+	proxy, _ := unifi.ParseProxy(cfg.UniFi.Proxy)
+	if proxy != nil {
+		if proxyURL, _ := proxy(&http.Request{URL: u}); proxyURL != nil {
+			addr, via = controllerAddr(proxyURL), " (proxy)"
+		}
+	}
+	host, port, _ := net.SplitHostPort(addr)
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		dns.Status, dns.Detail = checkFail, err.Error()
+		dns.Hint = "check the host name in unifi.url"
+		if via != "" {
+			dns.Hint = "check the proxy host in unifi.proxy or HTTPS_PROXY"
+		}
+		return []doctorCheck{dns, tcp, tlsCheck}
+	}
+	dns.Status, dns.Detail = checkPass, fmt.Sprintf("%s%s resolves to %s", host, via, strings.Join(addrs, ", "))
+
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		tcp.Status, tcp.Detail = checkFail, err.Error()
+		tcp.Hint = fmt.Sprintf("check that port %s is reachable from this host and not blocked by a firewall", port)
+		return []doctorCheck{dns, tcp, tlsCheck}
+	}
+	conn.Close()
+	tcp.Status, tcp.Detail = checkPass, fmt.Sprintf("connected to %s%s", addr, via)
+
+	if u.Scheme != "https" {
+		return []doctorCheck{dns, tcp, tlsCheck}
+	}
+	certs, err := unifi.FetchCertificates(ctx, cfg.UniFi.URL, unifi.ClientOptions{
+		ClientCertFile: cfg.UniFi.ClientCertFile,
+		ClientKeyFile:  cfg.UniFi.ClientKeyFile,
+		Proxy:          cfg.UniFi.Proxy,
+	})
+	if err != nil {
+		tlsCheck.Status, tlsCheck.Detail = checkFail, err.Error()
+		tlsCheck.Hint = "check that unifi.url points to the console's HTTPS port"
+		return []doctorCheck{dns, tcp, tlsCheck}
+	}
+	leaf := certs[0]
+	tlsCheck.Detail = fmt.Sprintf("%s, expires %s, SPKI SHA-256 %s",
+		leaf.Subject, leaf.NotAfter.UTC().Format(time.DateOnly), unifi.SPKIFingerprint(leaf))
+	if err := client.Ping(ctx); err != nil {
+		tlsCheck.Status, tlsCheck.Detail = checkFail, fmt.Sprintf("%v (%s)", err, tlsCheck.Detail)
+		tlsCheck.Hint = "pin the certificate in unifi.pinnedSHA256 or trust its CA with unifi.caFile; unifi-backup trust prints the fingerprint"
+		return []doctorCheck{dns, tcp, tlsCheck}
+	}
+	tlsCheck.Status = checkPass
+	if time.Until(leaf.NotAfter) < certificateExpiryWarning {
+		tlsCheck.Status = checkWarn
+		tlsCheck.Hint = "the certificate expires soon; update the pin or CA file after it is renewed"
+	}
+	return []doctorCheck{dns, tcp, tlsCheck}
+}
+
+// controllerAddr returns the host:port to connect to for u
+func controllerAddr(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	port := "443"
+	switch u.Scheme {
+	case "http":
+		port = "80"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// controllerChecks logs in and runs the preflight checks. Checks that depend
+// on a failed one are skipped.
+func controllerChecks(ctx context.Context, cfg *config.Config, client *unifi.Client) []doctorCheck {
+	login := doctorCheck{Name: "login", Status: checkPass, Detail: fmt.Sprintf("logged in as %q", cfg.UniFi.Username)}
+	role := doctorCheck{Name: "role", Status: checkSkip}
+	site := doctorCheck{Name: "site", Status: checkSkip}
+
+	if err := client.Login(ctx, cfg.UniFi.Username, cfg.UniFi.Password); err != nil {
+		login.Status, login.Detail = checkFail, err.Error()
+		login.Hint = "check unifi.url, unifi.username and unifi.password of a local UniFi OS user"
+		return []doctorCheck{login, role, site}
+	}
+	// The doctor never saves its session, so always end it
+	defer func() {
+		logoutCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), logoutTimeout)
+		defer cancel()
+		if err := client.Logout(logoutCtx); err != nil {
+			slog.Warn("Failed to log out of controller", "error", err)
+		}
+	}()
+
+	account, err := client.Preflight(ctx)
+	var preflightErr *unifi.PreflightError
+	switch {
+	case err == nil:
+		role.Status, role.Detail = checkPass, fmt.Sprintf("%q is a UniFi Network administrator", account.Network.Name)
+		if _, known := account.IsAdministrator(); !known {
+			role.Status, role.Detail = checkWarn, fmt.Sprintf("cannot tell whether %q is a UniFi Network administrator", account.Network.Name)
+			role.Hint = "backups need the Administrator (Full Management) role for UniFi Network; Site Administrators cannot create them"
+		}
+		site.Status, site.Detail = checkPass, fmt.Sprintf("site %q (%s)", account.Site.Name, account.Site.Desc)
+	case errors.Is(err, unifi.ErrNotAdministrator) && errors.As(err, &preflightErr):
+		role.Status, role.Detail, role.Hint = checkFail, preflightErr.Detail, preflightErr.Hint
+	case errors.Is(err, unifi.ErrSiteNotFound) && errors.As(err, &preflightErr):
+		role.Status, role.Detail = checkPass, fmt.Sprintf("%q is a UniFi Network administrator", account.Network.Name)
+		site.Status, site.Detail, site.Hint = checkFail, preflightErr.Detail, preflightErr.Hint
+	default:
+		role.Status, role.Detail = checkFail, err.Error()
+	}
+	return []doctorCheck{login, role, site}
+}
+
+// storageChecks writes, lists and deletes a canary object in every storage
+// target
+func storageChecks(ctx context.Context, cfg *config.Config) []doctorCheck {
+	var checks []doctorCheck
+	for _, target := range cfg.StorageTargets() {
+		check := doctorCheck{Name: "storage " + target.Name, Status: checkPass}
+		if err := storageCanary(ctx, target.URL); err != nil {
+			check.Status, check.Detail = checkFail, err.Error()
+			check.Hint = "check the storage URL, its credentials and that the account may create and delete files"
+		} else {
+			check.Detail = "wrote, listed and deleted a canary object"
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// storageCanary writes a small object to the store at storageURL, checks that
+// List returns it and deletes it again
+func storageCanary(ctx context.Context, storageURL string) error {
+	store, err := storage.Open(ctx, storageURL)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer store.Close()
+
+	// List only returns backups, so the canary needs their suffix
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	key := storage.BackupPrefix + "doctor-canary-" + hex.EncodeToString(suffix) + storage.BackupSuffix
+	if _, err := store.Put(ctx, key, strings.NewReader("unifi-backup doctor canary\n")); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	deleted := false
+	defer func() {
+		// Best effort when listing failed
+		if !deleted {
+			_ = store.Delete(context.WithoutCancel(ctx), key)
+		}
+	}()
+
+	objects, err := store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	if !slices.ContainsFunc(objects, func(obj storage.ObjectInfo) bool { return obj.Key == key }) {
+		return fmt.Errorf("list: canary object %s is missing", key)
+	}
+
+	deleted = true
+	if err := store.Delete(ctx, key); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	return nil
+}
+
+// doctorWriters maps the -format values of the doctor subcommand to their
+// writers
+var doctorWriters = map[string]func(w io.Writer, checks []doctorCheck) error{
+	"table": writeDoctorTable,
+	"json":  writeDoctorJSON,
+}
+
+func writeDoctorTable(w io.Writer, checks []doctorCheck) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL\tHINT")
+	for _, check := range checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", check.Name, check.Status, valueOrDash(check.Detail), valueOrDash(check.Hint))
+	}
+	return tw.Flush()
+}
+
+func writeDoctorJSON(w io.Writer, checks []doctorCheck) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(checks)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/config"
+	"github.com/ConnorsApps/unifi-backup/pkg/storage"
+	"github.com/ConnorsApps/unifi-backup/pkg/unifi"
+)
+
+// runFetch implements the fetch subcommand, which downloads a stored backup
+// to a local file or stdout
+func runFetch(args []string) int {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML or JSON)")
+	storageFlag := fs.String("storage", "", "Storage URL or storage target name (defaults to the first configured target)")
+	key := fs.String("key", "", "Exact key of the backup to fetch")
+	at := fs.String("at", "", "Fetch the backup nearest to this time (e.g. 2025-01-31 or 2025-01-31T12:00:00Z) instead of the latest")
+	site := fs.String("site", "", "Only consider backups of this site")
+	output := fs.String("o", "", `Output file, or "-" for stdout (defaults to the backup's file name)`)
+	force := fs.Bool("force", false, "Overwrite an existing output file")
+	restoreTo := fs.String("restore-to", "", "UniFi Network version of the controller the backup will be restored onto; warns when the backup is newer")
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	// Keep stdout free for the backup itself
+	cfg.SetupLoggerTo(os.Stderr)
+
+	var atTime time.Time
+	if *at != "" {
+		if atTime, err = parseTime(*at); err != nil {
+			slog.Error("Invalid -at value", "error", err)
+			return 2
+		}
+	}
+	if *key != "" && (*at != "" || *site != "") {
+		slog.Error("-key cannot be combined with -at or -site")
+		return 2
+	}
+	layout, err := cfg.KeyLayout()
+	if err != nil {
+		slog.Error("Invalid storage key template", "error", err)
+		return 1
+	}
+	catalogMaxAge, _ := cfg.CatalogMaxAge()
+
+	target := cfg.StorageTargets()[0]
+	if *storageFlag != "" {
+		target = selectStorageTargets(cfg, *storageFlag)[0]
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	store, err := storage.Open(ctx, target.URL)
+	if err != nil {
+		slog.Error("Error opening storage", "target", target.Name, "error", err)
+		return 1
+	}
+	defer store.Close()
+
+	var backup storage.ObjectInfo
+	if *key != "" {
+		backup, err = store.Stat(ctx, *key)
+	} else {
+		backup, err = findBackup(ctx, store, layout, catalogMaxAge, *site, atTime)
+	}
+	if err != nil {
+		slog.Error("Failed to find backup", "target", target.Name, "error", err)
+		return 1
+	}
+
+	outPath := *output
+	if outPath == "" {
+		outPath = path.Base(backup.Key)
+	}
+
+	slog.Info("Fetching backup", "target", target.Name, "key", backup.Key, "size", storage.FormatBytes(backup.Size), "output", outPath)
+	manifest, err := fetchBackup(ctx, store, backup, outPath, *force)
+	if err != nil {
+		slog.Error("Failed to fetch backup", "key", backup.Key, "error", err)
+		return 1
+	}
+	if *restoreTo != "" {
+		checkRestoreVersion(manifest, *restoreTo)
+	}
+	return 0
+}
+
+// checkRestoreVersion warns when the backup described by manifest cannot be
+// restored onto a controller running version, because UniFi Network only
+// restores backups of the same or an older version
+func checkRestoreVersion(manifest *storage.Manifest, version string) {
+	if manifest == nil || manifest.Version == "" {
+		slog.Warn("Backup version is unknown; run verify to read it from the backup", "restore_to", version)
+		return
+	}
+	cmp, err := unifi.CompareVersions(manifest.Version, version)
+	switch {
+	case err != nil:
+		slog.Warn("Cannot compare versions", "backup_version", manifest.Version, "restore_to", version, "error", err)
+	case cmp > 0:
+		slog.Warn("Backup was created by a newer UniFi Network version and cannot be restored; upgrade the controller first",
+			"backup_version", manifest.Version, "restore_to", version)
+	default:
+		slog.Info("Backup can be restored onto this version", "backup_version", manifest.Version, "restore_to", version)
+	}
+}
+
+// findBackup returns the latest backup in store, or the one nearest to at
+// when it is set, optionally restricted to a site
+func findBackup(ctx context.Context, store storage.ObjectStore, layout *storage.KeyLayout, catalogMaxAge time.Duration, site string, at time.Time) (storage.ObjectInfo, error) {
+	catalog, err := storage.LoadCatalog(ctx, store, catalogMaxAge)
+	if err != nil {
+		return storage.ObjectInfo{}, fmt.Errorf("list backups: %w", err)
+	}
+
+	var best *listedBackup
+	rows := listBackups("", catalog, layout, storage.KeyData{}, 0)
+	for i, row := range rows {
+		if site != "" && !strings.EqualFold(row.Site, site) {
+			continue
+		}
+		// Rows are sorted newest first
+		if at.IsZero() {
+			best = &rows[i]
+			break
+		}
+		if best == nil || absDuration(row.Time.Sub(at)) < absDuration(best.Time.Sub(at)) {
+			best = &rows[i]
+		}
+	}
+	if best == nil {
+		return storage.ObjectInfo{}, errors.New("no matching backup found")
+	}
+	return storage.ObjectInfo{Key: best.Key, Size: best.Size}, nil
+}
+
+// fetchBackup streams backup from store to outPath, or stdout when outPath is
+// "-", and checks it against the backup's manifest if there is one, which it
+// returns. Files are written under a temporary name and only renamed into
+// place once the checksum matches.
+func fetchBackup(ctx context.Context, store storage.ObjectStore, backup storage.ObjectInfo, outPath string, force bool) (*storage.Manifest, error) {
+	manifest, err := storage.ReadManifest(ctx, store, backup.Key)
+	if errors.Is(err, storage.ErrNotExist) {
+		slog.Warn("Backup has no manifest; its checksum cannot be verified", "key", backup.Key)
+		manifest = nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		slog.Info("Backup source",
+			"version", valueOrDash(manifest.Version),
+			"hostname", valueOrDash(manifest.Hostname),
+			"model", valueOrDash(manifest.Model),
+		)
+	}
+
+	reader, err := store.Get(ctx, backup.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var out io.Writer = os.Stdout
+	var tmpFile *os.File
+	if outPath != "-" {
+		if _, err := os.Stat(outPath); err == nil && !force {
+			return nil, fmt.Errorf("%s already exists (use -force to overwrite)", outPath)
+		}
+		tmpFile, err = os.CreateTemp(filepath.Dir(outPath), "."+filepath.Base(outPath)+".*.partial")
+		if err != nil {
+			return nil, fmt.Errorf("create output file: %w", err)
+		}
+		defer func() {
+			// Only left over when the fetch failed
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}()
+		out = tmpFile
+	}
+
+	hash := sha256.New()
+	written, err := io.Copy(out, io.TeeReader(storage.NewProgressReader(reader, backup.Size), hash))
+	if err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	if manifest != nil {
+		if manifest.Size > 0 && written != manifest.Size {
+			return nil, fmt.Errorf("size mismatch: manifest records %d bytes, fetched %d", manifest.Size, written)
+		}
+		if manifest.SHA256 != "" && !strings.EqualFold(checksum, manifest.SHA256) {
+			return nil, fmt.Errorf("checksum mismatch: manifest records %s, fetched %s", manifest.SHA256, checksum)
+		}
+		slog.Info("Checksum verified", "sha256", checksum)
+	}
+
+	if tmpFile != nil {
+		if err := tmpFile.Close(); err != nil {
+			return nil, fmt.Errorf("write output file: %w", err)
+		}
+		if err := os.Rename(tmpFile.Name(), outPath); err != nil {
+			return nil, fmt.Errorf("rename output file: %w", err)
+		}
+	}
+
+	slog.Info("Backup fetched", "key", backup.Key, "size", storage.FormatBytes(written), "sha256", checksum)
+	return manifest, nil
+}
+
+// parseTime parses an RFC 3339 time, a date, or a backup key timestamp
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, time.DateOnly, storage.TimeFormat} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a valid time", value)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/config"
+	"github.com/ConnorsApps/unifi-backup/pkg/storage"
+)
+
+// listedBackup is a single row of the list subcommand output
+type listedBackup struct {
+	Target      string    `json:"target"`
+	Key         string    `json:"key"`
+	Time        time.Time `json:"time"`
+	Size        int64     `json:"size"`
+	Site        string    `json:"site,omitempty"`
+	Controller  string    `json:"controller,omitempty"`
+	Version     string    `json:"version,omitempty"`
+	HasManifest bool      `json:"hasManifest"`
+	// Verification is "passed" or "failed" after a restore test
+	Verification string `json:"verification,omitempty"`
+	// DeleteNext is set for backups that retention deletes after the next
+	// backup run
+	DeleteNext bool `json:"deleteNext"`
+}
+
+// runList implements the list subcommand, which prints the backups stored in
+// each storage target
+func runList(args []string) int {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML or JSON)")
+	storageFlag := fs.String("storage", "", "Storage URL or storage target name (defaults to all configured targets)")
+	format := fs.String("format", "table", "Output format: table, json or csv")
+	since := fs.String("since", "", "Only list backups newer than a duration (e.g. 168h) or date (e.g. 2025-01-31)")
+	site := fs.String("site", "", "Only list backups of this site")
+	limit := fs.Int("limit", 0, "Maximum number of backups to list per target (0 = unlimited)")
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	// Keep stdout free for the listing
+	cfg.SetupLoggerTo(os.Stderr)
+
+	write, ok := listWriters[strings.ToLower(*format)]
+	if !ok {
+		slog.Error("Invalid output format", "format", *format)
+		return 2
+	}
+	var cutoff time.Time
+	if *since != "" {
+		if cutoff, err = parseSince(*since, time.Now()); err != nil {
+			slog.Error("Invalid -since value", "error", err)
+			return 2
+		}
+	}
+	layout, err := cfg.KeyLayout()
+	if err != nil {
+		slog.Error("Invalid storage key template", "error", err)
+		return 1
+	}
+	catalogMaxAge, _ := cfg.CatalogMaxAge()
+	current := backupKeyData(cfg, time.Now())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exitCode := 0
+	var rows []listedBackup
+	for _, target := range selectStorageTargets(cfg, *storageFlag) {
+		store, err := storage.Open(ctx, target.URL)
+		if err != nil {
+			slog.Error("Error opening storage", "target", target.Name, "error", err)
+			exitCode = 1
+			continue
+		}
+		catalog, err := storage.LoadCatalog(ctx, store, catalogMaxAge)
+		store.Close()
+		if err != nil {
+			slog.Error("Failed to list backups", "target", target.Name, "error", err)
+			exitCode = 1
+			continue
+		}
+
+		targetRows := listBackups(target.Name, catalog, layout, current, *target.KeepLast)
+		n := 0
+		for _, row := range targetRows {
+			if !cutoff.IsZero() && row.Time.Before(cutoff) {
+				continue
+			}
+			if *site != "" && !strings.EqualFold(row.Site, *site) {
+				continue
+			}
+			if *limit > 0 && n == *limit {
+				break
+			}
+			rows = append(rows, row)
+			n++
+		}
+	}
+
+	if err := write(os.Stdout, rows, time.Now()); err != nil {
+		slog.Error("Failed to write listing", "error", err)
+		return 1
+	}
+	return exitCode
+}
+
+// listBackups returns the backups in catalog newest first. Backups of the
+// configured controller and site are marked when keeping the last keepLast
+// backups would delete them after the next backup run.
+func listBackups(target string, catalog *storage.Catalog, layout *storage.KeyLayout, current storage.KeyData, keepLast int) []listedBackup {
+	deleteNext := make(map[string]bool)
+	if keepLast > 0 {
+		// The next run adds a backup before cleaning up, so one fewer of the
+		// existing backups survives
+		for _, backup := range retentionDeletions(retentionBackups(catalog, layout, current), keepLast-1) {
+			deleteNext[backup.filename] = true
+		}
+	}
+
+	rows := make([]listedBackup, 0, len(catalog.Backups))
+	for _, entry := range catalog.Backups {
+		row := listedBackup{
+			Target:      target,
+			Key:         entry.Key,
+			Time:        entry.ModTime,
+			Size:        entry.Size,
+			HasManifest: entry.Manifest != nil,
+			DeleteNext:  deleteNext[entry.Key],
+		}
+		if data, err := layout.Parse(entry.Key); err == nil {
+			row.Time = data.Time
+			row.Site = data.Site
+			row.Controller = data.Controller
+			row.Version = data.Version
+		}
+		if entry.Manifest != nil {
+			if !entry.Manifest.CreatedAt.IsZero() {
+				row.Time = entry.Manifest.CreatedAt
+			}
+			if v := entry.Manifest.Verification; v != nil {
+				row.Verification = "failed"
+				if v.OK {
+					row.Verification = "passed"
+				}
+			}
+			data := entry.Manifest.KeyData()
+			row.Site = data.Site
+			row.Controller = data.Controller
+			row.Version = data.Version
+		}
+		rows = append(rows, row)
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Time.After(rows[j].Time) })
+	return rows
+}
+
+// parseSince returns the cutoff time for a -since value, which is either a
+// duration before now or a date
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := parseTime(value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration nor a date", value)
+}
+
+// listWriters maps the -format values of the list subcommand to their writers
+var listWriters = map[string]func(w io.Writer, rows []listedBackup, now time.Time) error{
+	"table": writeListTable,
+	"json":  writeListJSON,
+	"csv":   writeListCSV,
+}
+
+func writeListTable(w io.Writer, rows []listedBackup, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tKEY\tTIME\tAGE\tSIZE\tSITE\tCONTROLLER\tVERSION\tMANIFEST\tVERIFIED\tRETENTION")
+	for _, row := range rows {
+		manifest, retention := "no", "-"
+		if row.HasManifest {
+			manifest = "yes"
+		}
+		if row.DeleteNext {
+			retention = "delete next"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			row.Target,
+			row.Key,
+			row.Time.UTC().Format(time.RFC3339),
+			formatAge(now.Sub(row.Time)),
+			storage.FormatBytes(row.Size),
+			valueOrDash(row.Site),
+			valueOrDash(row.Controller),
+			valueOrDash(row.Version),
+			manifest,
+			valueOrDash(row.Verification),
+			retention,
+		)
+	}
+	return tw.Flush()
+}
+
+func writeListJSON(w io.Writer, rows []listedBackup, _ time.Time) error {
+	if rows == nil {
+		rows = []listedBackup{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
+
+func writeListCSV(w io.Writer, rows []listedBackup, now time.Time) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"target", "key", "time", "age_seconds", "size", "site", "controller", "version", "has_manifest", "verification", "delete_next"})
+	for _, row := range rows {
+		_ = cw.Write([]string{
+			row.Target,
+			row.Key,
+			row.Time.UTC().Format(time.RFC3339),
+			strconv.FormatInt(int64(now.Sub(row.Time).Seconds()), 10),
+			strconv.FormatInt(row.Size, 10),
+			row.Site,
+			row.Controller,
+			row.Version,
+			strconv.FormatBool(row.HasManifest),
+			row.Verification,
+			strconv.FormatBool(row.DeleteNext),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatAge formats a duration with its two most significant units, e.g.
+// "3d4h" or "12m"
+func formatAge(d time.Duration) string {
+	if d < time.Minute {
+		return "<1m"
+	}
+	days := int(d / (24 * time.Hour))
+	hours := int(d % (24 * time.Hour) / time.Hour)
+	minutes := int(d % time.Hour / time.Minute)
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
+
+func valueOrDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
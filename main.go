@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
+	"fmt"
+	"io"
 	"log/slog"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -24,7 +30,28 @@ var (
 	Commit  = "unknown"
 )
 
+// subcommands maps subcommand names to their entry points. Each receives the
+// arguments following the subcommand name and returns the process exit code.
+var subcommands = map[string]func(args []string) int{
+	"doctor":       runDoctor,
+	"fetch":        runFetch,
+	"list":         runList,
+	"migrate-keys": runMigrateKeys,
+	"reindex":      runReindex,
+	"status":       runStatus,
+	"sync":         runSync,
+	"trust":        runTrust,
+	"verify":       runVerify,
+}
+
 func main() {
+	// Dispatch subcommands before parsing the backup flags
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	// Parse command-line flags
 	configPath := flag.String("config", "", "Path to configuration file (YAML or JSON)")
 	showVersion := flag.Bool("version", false, "Show version information and exit")
@@ -43,13 +70,21 @@ func main() {
 		os.Exit(1)
 	}
 
+	os.Exit(runBackup(cfg))
+}
+
+// runBackup takes a backup of the configured controller, uploads it to every
+// storage target and applies retention. It returns the process exit code.
+func runBackup(cfg *config.Config) int {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
 	cfg.SetupLogger()
 
-	// Extract config values
-	storageURL := cfg.Storage.URL
+	// Tag every log line of this run so it can be matched with its manifests
+	runID := newRunID()
+	startedAt := time.Now()
+	slog.SetDefault(slog.Default().With("run_id", runID))
 
 	slog.Info("Starting UniFi backup",
 		"version", Version,
@@ -62,93 +97,362 @@ func main() {
 	timeout, err := time.ParseDuration(cfg.UniFi.Timeout)
 	if err != nil {
 		slog.Error("Invalid timeout duration", "error", err)
-		os.Exit(1)
+		return 1
+	}
+
+	retryPolicy, err := cfg.RetryPolicy()
+	if err != nil {
+		slog.Error("Invalid retry policy", "error", err)
+		return 1
 	}
 
 	// Create UniFi client
-	client, err := unifi.NewClient(cfg.UniFi.URL, unifi.ClientOptions{
-		Site:               cfg.UniFi.Site,
-		InsecureSkipVerify: cfg.UniFi.InsecureSkipVerify,
-		Timeout:            timeout,
-	})
+	client, err := newUniFiClient(cfg, timeout, retryPolicy)
 	if err != nil {
 		slog.Error("Failed to create UniFi client", "error", err)
-		os.Exit(1)
+		return 1
 	}
+	defer client.Close()
+
+	// Skip the run while the controller keeps failing
+	breaker, err := openControllerBreaker(cfg)
+	if err != nil {
+		slog.Error("Failed to load circuit breaker state", "error", err)
+		return 1
+	}
+	if breaker != nil && !breaker.allow(ctx, client) {
+		return 1
+	}
+
+	// End the session however the run ends. The context is detached so that
+	// the logout is still sent after cancellation.
+	defer logout(ctx, cfg, client)
 
 	// 1. Login with timeout
 	loginCtx, loginCancel := context.WithTimeout(ctx, 30*time.Second)
 	defer loginCancel()
 
-	if err := client.Login(loginCtx, cfg.UniFi.Username, cfg.UniFi.Password); err != nil {
-		slog.Error("Login failed", "error", err)
-		os.Exit(1)
+	// Reuse the session of an earlier run when it is still valid
+	resumed := false
+	if cfg.UniFi.SessionFile != "" {
+		resumed, err = client.RestoreSession(loginCtx, cfg.UniFi.SessionFile, cfg.UniFi.Username, cfg.UniFi.Password)
+		if err != nil {
+			slog.Warn("Failed to reuse saved session, logging in", "error", err)
+		}
+	}
+	if !resumed {
+		err = retryPolicy.WithMaxRetries(cfg.Retry.Login).Retry(loginCtx, func() error {
+			return client.Login(loginCtx, cfg.UniFi.Username, cfg.UniFi.Password)
+		})
+		if err != nil {
+			breaker.failure(err)
+			slog.Error("Login failed", "error", err)
+			return 1
+		}
+		saveSession(cfg, client)
+	}
+
+	// Fail before triggering the backup when the account cannot take it
+	account, err := backoff.RetryValue(loginCtx, retryPolicy.WithMaxRetries(cfg.Retry.Login), func() (*unifi.Account, error) {
+		return client.Preflight(loginCtx)
+	})
+	if err != nil {
+		breaker.failure(err)
+		slog.Error("Preflight check failed", "error", err)
+		return 1
+	}
+	slog.Info("Preflight check passed", "user", account.Network.Name, "site", account.Site.Name)
+
+	// System info is only used for metadata, so a failure is not fatal
+	sysInfo, err := client.SystemInfo(loginCtx)
+	if err != nil {
+		slog.Warn("Failed to read controller system info", "error", err)
+		sysInfo = &unifi.SystemInfo{}
+	} else {
+		slog.Info("Controller system info",
+			"version", sysInfo.Version,
+			"hostname", sysInfo.Hostname,
+			"model", sysInfo.Model,
+			"uptime", sysInfo.Uptime,
+		)
 	}
 
 	// 2. Trigger backup with timeout
 	backupCtx, backupCancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer backupCancel()
 
-	backupURL, err := client.CreateBackup(backupCtx, cfg.UniFi.Username, cfg.UniFi.IncludeDays)
+	backupURL, err := backoff.RetryValue(backupCtx, retryPolicy.WithMaxRetries(cfg.Retry.CreateBackup), func() (string, error) {
+		return client.CreateBackup(backupCtx, cfg.UniFi.Username, cfg.UniFi.IncludeDays)
+	})
 	if err != nil {
+		breaker.failure(err)
 		slog.Error("Backup creation failed", "error", err)
-		os.Exit(1)
+		return 1
 	}
 
 	// 3. Download backup with retry logic
-	var dlResp *unifi.DownloadResponse
 	downloadCtx, downloadCancel := context.WithTimeout(ctx, timeout)
 	defer downloadCancel()
 
-	err = backoff.Retry(downloadCtx, cfg.UniFi.MaxRetries, func() error {
-		var err error
-		dlResp, err = client.DownloadBackup(downloadCtx, backupURL)
-		return err
+	dlResp, err := backoff.RetryValue(downloadCtx, retryPolicy.WithMaxRetries(cfg.UniFi.MaxRetries), func() (*unifi.DownloadResponse, error) {
+		return client.DownloadBackup(downloadCtx, backupURL)
 	})
 	if err != nil {
+		breaker.failure(err)
 		slog.Error("Failed to download backup after retries", "error", err)
-		os.Exit(1)
+		return 1
 	}
 	defer dlResp.Body.Close()
+	breaker.success()
+	// Keep the CSRF token refreshed during this run for the next one
+	saveSession(cfg, client)
 
-	outName := storage.GenerateBackupFilename()
-
-	store, err := storage.Open(ctx, storageURL)
+	layout, err := cfg.KeyLayout()
 	if err != nil {
-		slog.Error("Error opening storage", "error", err)
-		os.Exit(1)
+		slog.Error("Invalid storage key template", "error", err)
+		return 1
 	}
+	catalogMaxAge, err := cfg.CatalogMaxAge()
+	if err != nil {
+		slog.Error("Invalid catalog max age", "error", err)
+		return 1
+	}
+	keyData := backupKeyData(cfg, time.Now())
+	keyData.Hostname = sysInfo.Hostname
+	keyData.Version = sysInfo.Version
+	outName, err := layout.Key(keyData)
+	if err != nil {
+		slog.Error("Failed to generate backup key", "error", err)
+		return 1
+	}
+
+	// Open every storage target; best-effort targets that fail to open are skipped
+	targets := cfg.StorageTargets()
+	var dests []storage.Destination
+	keepLast := make(map[string]int, len(targets))
+	for _, target := range targets {
+		store, err := storage.Open(ctx, target.URL)
+		if err != nil {
+			if target.Required() {
+				slog.Error("Error opening storage", "target", target.Name, "error", err)
+				return 1
+			}
+			slog.Warn("Skipping best-effort storage target", "target", target.Name, "error", err)
+			continue
+		}
+		defer store.Close()
 
-	defer store.Close()
+		dests = append(dests, storage.Destination{
+			Name:     target.Name,
+			Store:    store,
+			Required: target.Required(),
+		})
+		keepLast[target.Name] = *target.KeepLast
+	}
+	if len(dests) == 0 {
+		slog.Error("No storage targets could be opened")
+		return 1
+	}
 
 	// Wrap the response body with a progress reader for logging
 	progressReader := storage.NewProgressReader(dlResp.Body, dlResp.ContentLength)
+	hash := sha256.New()
 
-	written, err := store.Put(ctx, outName, progressReader)
-	if err != nil {
-		slog.Error("Failed to save backup", "error", err)
-		os.Exit(1)
+	var results []storage.PutResult
+	if cfg.Spool.Enabled {
+		// Download and check the whole backup first, then upload the local
+		// copy with retries that do not touch the controller
+		spool, err := spoolBackup(cfg, io.TeeReader(progressReader, hash), dlResp.ContentLength)
+		if err != nil {
+			slog.Error("Failed to spool backup", "error", err)
+			return 1
+		}
+		defer spool.Close()
+		dlResp.Body.Close()
+
+		results = storage.UploadSpool(ctx, outName, spool, dests, retryPolicy.WithMaxRetries(cfg.Retry.Upload))
+	} else {
+		// Stream the download to all targets at once, then retry failed
+		// targets by copying from one that succeeded
+		results = storage.FanOut(ctx, outName, storage.NewSizedReader(io.TeeReader(progressReader, hash), dlResp.ContentLength), dests)
+		storage.RetryFailedUploads(ctx, outName, results, dests, retryPolicy.WithMaxRetries(cfg.Retry.Upload))
 	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	// Every manifest records the same run, however long cleanup of earlier
+	// targets took
+	duration := time.Since(startedAt).Seconds()
+
+	failedRequired := false
+	for i, res := range results {
+		if res.Err != nil {
+			if res.Required {
+				slog.Error("Failed to save backup", "target", res.Name, "error", res.Err)
+				failedRequired = true
+			} else {
+				slog.Warn("Failed to save backup to best-effort target", "target", res.Name, "error", res.Err)
+			}
+			continue
+		}
 
-	// Verify backup size matches expected
-	if dlResp.ContentLength > 0 && written != dlResp.ContentLength {
-		slog.Warn("Backup size mismatch",
-			"expected_bytes", dlResp.ContentLength,
-			"written_bytes", written,
+		// Verify backup size matches expected
+		if dlResp.ContentLength > 0 && res.Written != dlResp.ContentLength {
+			slog.Warn("Backup size mismatch",
+				"target", res.Name,
+				"expected_bytes", dlResp.ContentLength,
+				"written_bytes", res.Written,
+			)
+		}
+
+		slog.Info(
+			"Backup saved successfully",
+			"target", res.Name,
+			"filename", outName,
+			"size", storage.FormatBytes(res.Written),
 		)
-	}
 
-	slog.Info(
-		"Backup saved successfully",
-		"filename", outName,
-		"size", storage.FormatBytes(written),
-	)
+		manifest := &storage.Manifest{
+			Key:             outName,
+			RunID:           runID,
+			CreatedAt:       keyData.Time.UTC(),
+			ControllerURL:   cfg.UniFi.URL,
+			Hostname:        sysInfo.Hostname,
+			Site:            cfg.UniFi.Site,
+			Version:         sysInfo.Version,
+			Model:           sysInfo.Model,
+			UptimeSeconds:   int64(sysInfo.Uptime / time.Second),
+			IncludeDays:     cfg.UniFi.IncludeDays,
+			Size:            res.Written,
+			SHA256:          checksum,
+			DurationSeconds: duration,
+			ToolVersion:     Version,
+			ToolCommit:      Commit,
+		}
+		if err := storage.WriteManifest(ctx, dests[i].Store, manifest); err != nil {
+			// The backup itself is intact, so only warn
+			slog.Warn("Failed to write backup manifest", "target", res.Name, "error", err)
+			manifest = nil
+		}
 
-	// 4. Perform backup cleanup if enabled
-	if cfg.Retention.KeepLast > 0 {
-		if err := cleanupOldBackups(ctx, store, cfg.Retention.KeepLast); err != nil {
-			slog.Warn("Failed to cleanup old backups", "error", err)
-			// Don't fail the entire backup process on cleanup error
+		if cfg.Verify.AfterUpload {
+			verified, err := verifyBackup(ctx, dests[i].Store, outName, sysInfo.Version)
+			if verified != nil {
+				manifest = verified
+			}
+			if err != nil {
+				slog.Error("Uploaded backup failed verification", "target", res.Name, "error", err)
+				failedRequired = failedRequired || res.Required
+			}
 		}
+
+		if catalogMaxAge > 0 {
+			entry := storage.CatalogEntry{
+				Key:      outName,
+				Size:     res.Written,
+				ModTime:  time.Now().UTC(),
+				Manifest: manifest,
+			}
+			if err := storage.UpdateCatalog(ctx, dests[i].Store, func(c *storage.Catalog) { c.Put(entry) }); err != nil {
+				// A stale catalog is rebuilt by the next full listing
+				slog.Warn("Failed to update catalog", "target", res.Name, "error", err)
+			}
+		}
+
+		// 4. Perform backup cleanup if enabled
+		if n := keepLast[res.Name]; n > 0 {
+			if err := cleanupOldBackups(ctx, dests[i].Store, layout, keyData, n, catalogMaxAge, retryPolicy.WithMaxRetries(cfg.Retry.Delete)); err != nil {
+				slog.Warn("Failed to cleanup old backups", "target", res.Name, "error", err)
+				// Don't fail the entire backup process on cleanup error
+			}
+		}
+	}
+
+	if failedRequired {
+		return 1
+	}
+	return 0
+}
+
+// spoolBackup reads the whole backup from r into a spool as configured by
+// cfg.Spool and checks its size against contentLength, if known
+func spoolBackup(cfg *config.Config, r io.Reader, contentLength int64) (*storage.Spool, error) {
+	maxMemory, err := cfg.SpoolMaxMemory()
+	if err != nil {
+		return nil, err
+	}
+	spool, err := storage.NewSpool(r, cfg.Spool.Dir, maxMemory)
+	if err != nil {
+		return nil, err
+	}
+	if contentLength > 0 && spool.Size() != contentLength {
+		spool.Close()
+		return nil, fmt.Errorf("downloaded %d bytes, controller announced %d", spool.Size(), contentLength)
+	}
+	slog.Info("Backup spooled", "size", storage.FormatBytes(spool.Size()))
+	return spool, nil
+}
+
+// backupKeyData returns the key template fields describing a backup of the
+// configured controller and site taken at t
+func backupKeyData(cfg *config.Config, t time.Time) storage.KeyData {
+	controller := cfg.UniFi.URL
+	if u, err := url.Parse(cfg.UniFi.URL); err == nil && u.Hostname() != "" {
+		controller = u.Hostname()
+	}
+	return storage.KeyData{
+		Controller: controller,
+		Site:       cfg.UniFi.Site,
+		Time:       t,
+	}
+}
+
+// newRunID returns a random identifier for a backup run
+func newRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newUniFiClient creates the controller client configured by cfg
+func newUniFiClient(cfg *config.Config, timeout time.Duration, retryPolicy backoff.Policy) (*unifi.Client, error) {
+	return unifi.NewClient(cfg.UniFi.URL, unifi.ClientOptions{
+		Site:               cfg.UniFi.Site,
+		InsecureSkipVerify: cfg.UniFi.InsecureSkipVerify,
+		CAFile:             cfg.UniFi.CAFile,
+		PinnedSHA256:       cfg.UniFi.PinnedSHA256,
+		ClientCertFile:     cfg.UniFi.ClientCertFile,
+		ClientKeyFile:      cfg.UniFi.ClientKeyFile,
+		Proxy:              cfg.UniFi.Proxy,
+		Timeout:            timeout,
+		DownloadRetries:    cfg.UniFi.MaxRetries,
+		Backoff:            &retryPolicy,
+	})
+}
+
+// logoutTimeout bounds the logout at the end of a run, which may follow a
+// cancellation
+const logoutTimeout = 10 * time.Second
+
+// logout ends the controller session unless unifi.sessionFile keeps it for
+// the next run
+func logout(ctx context.Context, cfg *config.Config, client *unifi.Client) {
+	if cfg.UniFi.SessionFile != "" {
+		slog.Debug("Keeping controller session for the next run", "path", cfg.UniFi.SessionFile)
+		return
+	}
+	logoutCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), logoutTimeout)
+	defer cancel()
+	if err := client.Logout(logoutCtx); err != nil {
+		slog.Warn("Failed to log out of controller", "error", err)
+	}
+}
+
+// saveSession stores the controller session in unifi.sessionFile, if set.
+// A failure only means that the next run logs in again.
+func saveSession(cfg *config.Config, client *unifi.Client) {
+	if cfg.UniFi.SessionFile == "" {
+		return
+	}
+	if err := client.SaveSession(cfg.UniFi.SessionFile, cfg.UniFi.Username, cfg.UniFi.Password); err != nil {
+		slog.Warn("Failed to save session", "path", cfg.UniFi.SessionFile, "error", err)
 	}
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/config"
+	"github.com/ConnorsApps/unifi-backup/pkg/storage"
+)
+
+// runMigrateKeys implements the migrate-keys subcommand, which renames
+// existing backups from one key layout to another
+func runMigrateKeys(args []string) int {
+	fs := flag.NewFlagSet("migrate-keys", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML or JSON)")
+	storageFlag := fs.String("storage", "", "Storage URL or storage target name (defaults to all configured targets)")
+	fromTemplate := fs.String("from-template", storage.DefaultKeyTemplate, "Key template the existing backups were written with")
+	toTemplate := fs.String("to-template", "", "Key template to migrate to (defaults to storage.keyTemplate)")
+	dryRun := fs.Bool("dry-run", false, "Log planned renames without copying or deleting")
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	cfg.SetupLogger()
+
+	from, err := storage.NewKeyLayout(*fromTemplate)
+	if err != nil {
+		slog.Error("Invalid source key template", "error", err)
+		return 2
+	}
+	to, err := cfg.KeyLayout()
+	if *toTemplate != "" {
+		to, err = storage.NewKeyLayout(*toTemplate)
+	}
+	if err != nil {
+		slog.Error("Invalid destination key template", "error", err)
+		return 2
+	}
+	if from.String() == to.String() {
+		slog.Error("Source and destination key templates are identical", "template", from.String())
+		return 2
+	}
+
+	catalogMaxAge, _ := cfg.CatalogMaxAge()
+
+	targets := selectStorageTargets(cfg, *storageFlag)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Backups in the old layout carry no controller or site, so assume they
+	// belong to the configured ones
+	opts := storage.MigrateOptions{
+		Defaults: backupKeyData(cfg, time.Time{}),
+		DryRun:   *dryRun,
+	}
+
+	exitCode := 0
+	for _, target := range targets {
+		store, err := storage.Open(ctx, target.URL)
+		if err != nil {
+			slog.Error("Error opening storage", "target", target.Name, "error", err)
+			exitCode = 1
+			continue
+		}
+
+		slog.Info("Migrating backup keys",
+			"target", target.Name,
+			"from", from.String(),
+			"to", to.String(),
+			"dry_run", *dryRun,
+		)
+		result, err := storage.MigrateKeys(ctx, store, from, to, opts)
+		if err == nil && catalogMaxAge > 0 && !*dryRun && result.Migrated > 0 {
+			// Every key changed, so rebuild the catalog from scratch
+			if _, err := storage.RebuildCatalog(ctx, store); err != nil {
+				slog.Warn("Failed to rebuild catalog", "target", target.Name, "error", err)
+			}
+		}
+		store.Close()
+		if err != nil {
+			slog.Error("Migration failed", "target", target.Name, "error", err)
+			return 1
+		}
+
+		slog.Info("Migration completed",
+			"target", target.Name,
+			"migrated", result.Migrated,
+			"skipped", result.Skipped,
+			"failed", result.Failed,
+		)
+		if result.Failed > 0 {
+			exitCode = 1
+		}
+	}
+
+	return exitCode
+}
@@ -2,44 +2,197 @@ package backoff
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
-const defaultRetryInitialDelay = 1 * time.Second
+// Jitter selects how a random part is mixed into each retry delay so that
+// many clients failing at the same time do not retry in lockstep.
+type Jitter string
 
-// retryWithBackoff attempts an operation with exponential backoff
-func Retry(ctx context.Context, maxRetries int, operation func() error) error {
-	var lastErr error
+const (
+	// JitterNone uses the exponential delay as is.
+	JitterNone Jitter = "none"
+	// JitterFull waits a random time between zero and the delay.
+	JitterFull Jitter = "full"
+	// JitterEqual waits half the delay plus a random time up to the other half.
+	JitterEqual Jitter = "equal"
+)
+
+// Clock tells the time and waits. Tests replace the real clock to run
+// retries without sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Policy describes how often and how long an operation is retried.
+//
+// The delay before retry n is InitialDelay * Multiplier^(n-1), capped at
+// MaxDelay, with Jitter applied. A Retry-After duration reported by the
+// failed operation is used instead when it is longer, even beyond MaxDelay.
+// Retrying stops when the next attempt would start after MaxElapsed.
+type Policy struct {
+	// MaxRetries is the number of retries after the first attempt
+	MaxRetries int
+	// InitialDelay is the delay before the first retry
+	InitialDelay time.Duration
+	// Multiplier grows the delay after each retry
+	Multiplier float64
+	// MaxDelay caps the computed delay, but not a Retry-After (0 for no cap)
+	MaxDelay time.Duration
+	// MaxElapsed stops retrying once the next attempt would start this long
+	// after the first one (0 for no limit)
+	MaxElapsed time.Duration
+	// Jitter randomizes the delays
+	Jitter Jitter
+	// Clock defaults to the real clock
+	Clock Clock
+	// Rand returns a random number in [0, 1) for jitter; defaults to
+	// math/rand/v2
+	Rand func() float64
+}
+
+// DefaultPolicy returns the policy used by Retry: a 1s initial delay that
+// doubles up to 30s, without jitter or elapsed time limit.
+func DefaultPolicy(maxRetries int) Policy {
+	return Policy{
+		MaxRetries:   maxRetries,
+		InitialDelay: time.Second,
+		Multiplier:   2,
+		MaxDelay:     30 * time.Second,
+		Jitter:       JitterNone,
+	}
+}
+
+// WithMaxRetries returns a copy of p with MaxRetries set to n.
+func (p Policy) WithMaxRetries(n int) Policy {
+	p.MaxRetries = n
+	return p
+}
+
+// Validate reports an invalid policy.
+func (p Policy) Validate() error {
+	switch {
+	case p.MaxRetries < 0:
+		return errors.New("max retries must be non-negative")
+	case p.InitialDelay < 0 || p.MaxDelay < 0 || p.MaxElapsed < 0:
+		return errors.New("delays must be non-negative")
+	case p.Multiplier != 0 && p.Multiplier < 1:
+		return errors.New("multiplier must be at least 1")
+	}
+	switch p.Jitter {
+	case "", JitterNone, JitterFull, JitterEqual:
+		return nil
+	}
+	return fmt.Errorf("unknown jitter %q (must be one of: none, full, equal)", p.Jitter)
+}
+
+// Delay returns the delay before retry number attempt, starting at 1.
+func (p Policy) Delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 1
+	}
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	random := p.Rand
+	if random == nil {
+		random = rand.Float64
+	}
+	switch p.Jitter {
+	case JitterFull:
+		delay = random() * delay
+	case JitterEqual:
+		delay = delay/2 + random()*delay/2
+	}
+	return time.Duration(delay)
+}
+
+func (p Policy) clock() Clock {
+	if p.Clock == nil {
+		return realClock{}
+	}
+	return p.Clock
+}
+
+// Retry runs operation until it succeeds, fails with an error that
+// IsRetryable rejects, or the policy is exhausted.
+func (p Policy) Retry(ctx context.Context, operation func() error) error {
+	_, err := RetryValue(ctx, p, func() (struct{}, error) {
+		return struct{}{}, operation()
+	})
+	return err
+}
 
-	for attempt := 0; attempt <= maxRetries; attempt++ {
+// RetryValue runs operation like Policy.Retry and returns the value of the
+// successful attempt.
+func RetryValue[T any](ctx context.Context, p Policy, operation func() (T, error)) (T, error) {
+	clock := p.clock()
+	start := clock.Now()
+
+	var zero T
+	var lastErr error
+	for attempt := 0; attempt <= p.MaxRetries; attempt++ {
 		if attempt > 0 {
-			// Calculate exponential backoff: 1s, 2s, 4s, 8s...
-			delay := time.Duration(math.Pow(2, float64(attempt-1))) * defaultRetryInitialDelay
-			if delay > 30*time.Second {
-				delay = 30 * time.Second // Cap at 30 seconds
+			delay := p.Delay(attempt)
+			// The server's Retry-After is honoured in full, also beyond
+			// MaxDelay; only MaxElapsed and ctx cut it short
+			if after := RetryAfter(lastErr); after > delay {
+				delay = after
+			}
+			if p.MaxElapsed > 0 && clock.Now().Add(delay).Sub(start) > p.MaxElapsed {
+				slog.Warn("Giving up retrying, time limit reached",
+					"attempts", attempt,
+					"max_elapsed", p.MaxElapsed,
+				)
+				return zero, lastErr
 			}
 
 			slog.Info("Retrying operation",
 				"attempt", attempt+1,
-				"max_attempts", maxRetries+1,
+				"max_attempts", p.MaxRetries+1,
 				"delay", delay,
 			)
 
 			select {
-			case <-time.After(delay):
+			case <-clock.After(delay):
 			case <-ctx.Done():
-				return ctx.Err()
+				return zero, ctx.Err()
 			}
 		}
 
-		lastErr = operation()
-		if lastErr == nil {
+		value, err := operation()
+		if err == nil {
 			if attempt > 0 {
 				slog.Info("Operation succeeded after retry", "attempts", attempt+1)
 			}
-			return nil
+			return value, nil
+		}
+		lastErr = err
+
+		if !IsRetryable(lastErr) {
+			slog.Warn("Operation failed permanently", "attempt", attempt+1, "error", lastErr)
+			if permanent, ok := lastErr.(*permanentError); ok {
+				return zero, permanent.err
+			}
+			return zero, lastErr
 		}
 
 		slog.Warn("Operation failed",
@@ -48,5 +201,82 @@ func Retry(ctx context.Context, maxRetries int, operation func() error) error {
 		)
 	}
 
-	return lastErr
+	return zero, lastErr
+}
+
+// Retry attempts an operation with the DefaultPolicy. It stops early when
+// the operation fails with an error that IsRetryable rejects.
+func Retry(ctx context.Context, maxRetries int, operation func() error) error {
+	return DefaultPolicy(maxRetries).Retry(ctx, operation)
+}
+
+// permanentError marks an error that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that Retry returns it without further attempts.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsRetryable reports whether an operation that failed with err may succeed
+// when it is repeated.
+//
+// Errors wrapped with Permanent, cancelled contexts and missing files or
+// objects (fs.ErrNotExist, which storage.ErrNotExist matches) are never
+// retried. Errors that implement Retryable() bool, such as unifi.APIError,
+// decide for themselves. All other errors, including network timeouts, are
+// retried.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var permanent *permanentError
+	if errors.As(err, &permanent) || errors.Is(err, context.Canceled) || errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	var classified interface{ Retryable() bool }
+	if errors.As(err, &classified) {
+		return classified.Retryable()
+	}
+	// Network timeouts, resets and other transient failures
+	return true
+}
+
+// RetryAfter returns how long the server asked to wait before the next
+// attempt, taken from an error in err's chain that implements
+// RetryAfter() time.Duration, or zero.
+func RetryAfter(err error) time.Duration {
+	var hinted interface{ RetryAfter() time.Duration }
+	if errors.As(err, &hinted) {
+		return hinted.RetryAfter()
+	}
+	return 0
+}
+
+// ParseRetryAfter parses the value of a Retry-After header, given either in
+// seconds or as an HTTP date relative to now. It returns zero for an empty
+// or invalid value.
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
 }
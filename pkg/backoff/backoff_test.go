@@ -0,0 +1,267 @@
+package backoff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeClock advances its time by the requested delay instead of sleeping
+// and records every delay
+type fakeClock struct {
+	now    time.Time
+	delays []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.delays = append(c.delays, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// retryAfterError asks for a fixed delay before the next attempt
+type retryAfterError struct{ wait time.Duration }
+
+func (e retryAfterError) Error() string             { return "rate limited" }
+func (e retryAfterError) RetryAfter() time.Duration { return e.wait }
+
+// classifiedError reports whether it is retryable
+type classifiedError struct{ retryable bool }
+
+func (e classifiedError) Error() string   { return "classified" }
+func (e classifiedError) Retryable() bool { return e.retryable }
+
+func TestPolicyDelay(t *testing.T) {
+	p := Policy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := p.Delay(i + 1); got != w {
+			t.Errorf("Delay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestPolicyDelayJitter(t *testing.T) {
+	p := Policy{InitialDelay: 4 * time.Second, Multiplier: 2, Rand: func() float64 { return 0.5 }}
+
+	p.Jitter = JitterFull
+	if got := p.Delay(1); got != 2*time.Second {
+		t.Errorf("full jitter Delay(1) = %v, want 2s", got)
+	}
+	p.Jitter = JitterEqual
+	if got := p.Delay(1); got != 3*time.Second {
+		t.Errorf("equal jitter Delay(1) = %v, want 3s", got)
+	}
+}
+
+func TestPolicyRetryWaitsBetweenAttempts(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	p := Policy{MaxRetries: 3, InitialDelay: time.Second, Multiplier: 2, Clock: clock}
+
+	attempts := 0
+	err := p.Retry(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("temporary")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+	if len(clock.delays) != 2 || clock.delays[0] != time.Second || clock.delays[1] != 2*time.Second {
+		t.Errorf("delays = %v, want [1s 2s]", clock.delays)
+	}
+}
+
+func TestPolicyRetryGivesUpAfterMaxRetries(t *testing.T) {
+	p := Policy{MaxRetries: 2, Clock: &fakeClock{}}
+
+	attempts := 0
+	err := p.Retry(context.Background(), func() error {
+		attempts++
+		return errors.New("temporary")
+	})
+	if err == nil || attempts != 3 {
+		t.Errorf("Retry() error = %v after %d attempts, want error after 3", err, attempts)
+	}
+}
+
+func TestPolicyRetryStopsOnPermanentError(t *testing.T) {
+	cause := errors.New("access denied")
+	p := Policy{MaxRetries: 5, Clock: &fakeClock{}}
+
+	notExist := fmt.Errorf("stat backup: %w", fs.ErrNotExist)
+	for _, opErr := range []error{Permanent(cause), classifiedError{retryable: false}, context.Canceled, notExist} {
+		attempts := 0
+		err := p.Retry(context.Background(), func() error {
+			attempts++
+			return opErr
+		})
+		if attempts != 1 {
+			t.Errorf("%v: attempts = %d, want 1", opErr, attempts)
+		}
+		if err == nil {
+			t.Errorf("%v: expected error", opErr)
+		}
+	}
+
+	err := p.Retry(context.Background(), func() error { return Permanent(cause) })
+	if err != cause {
+		t.Errorf("Retry() error = %v, want unwrapped cause", err)
+	}
+}
+
+func TestPolicyRetryHonoursRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     Policy
+		wait       time.Duration
+		wantDelays []time.Duration
+	}{
+		{
+			name:       "longer than the computed delay",
+			policy:     Policy{InitialDelay: time.Second, MaxDelay: time.Minute},
+			wait:       10 * time.Second,
+			wantDelays: []time.Duration{10 * time.Second},
+		},
+		{
+			name:       "beyond max delay",
+			policy:     Policy{InitialDelay: time.Second, MaxDelay: 2 * time.Second},
+			wait:       2 * time.Minute,
+			wantDelays: []time.Duration{2 * time.Minute},
+		},
+		{
+			name:       "within max elapsed",
+			policy:     Policy{InitialDelay: time.Second, MaxDelay: 2 * time.Second, MaxElapsed: time.Minute},
+			wait:       10 * time.Second,
+			wantDelays: []time.Duration{10 * time.Second},
+		},
+		{
+			name:       "beyond max elapsed",
+			policy:     Policy{InitialDelay: time.Second, MaxDelay: 2 * time.Second, MaxElapsed: 5 * time.Second},
+			wait:       10 * time.Second,
+			wantDelays: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{}
+			p := tt.policy
+			p.MaxRetries, p.Multiplier, p.Clock = 1, 2, clock
+
+			attempts := 0
+			_ = p.Retry(context.Background(), func() error {
+				attempts++
+				if attempts == 1 {
+					return retryAfterError{wait: tt.wait}
+				}
+				return nil
+			})
+			if !slices.Equal(clock.delays, tt.wantDelays) {
+				t.Errorf("delays = %v, want %v", clock.delays, tt.wantDelays)
+			}
+		})
+	}
+}
+
+func TestPolicyRetryStopsAtMaxElapsed(t *testing.T) {
+	clock := &fakeClock{}
+	p := Policy{MaxRetries: 10, InitialDelay: time.Second, Multiplier: 2, MaxElapsed: 5 * time.Second, Clock: clock}
+
+	attempts := 0
+	err := p.Retry(context.Background(), func() error {
+		attempts++
+		return errors.New("temporary")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	// Waits 1s and 2s; the next 4s delay would end after 7s
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3 (delays %v)", attempts, clock.delays)
+	}
+}
+
+func TestPolicyRetryStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := Policy{MaxRetries: 3, InitialDelay: time.Hour}
+
+	err := p.Retry(ctx, func() error {
+		cancel()
+		return errors.New("temporary")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Retry() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestRetryValue(t *testing.T) {
+	p := Policy{MaxRetries: 2, Clock: &fakeClock{}}
+
+	attempts := 0
+	got, err := RetryValue(context.Background(), p, func() (string, error) {
+		attempts++
+		if attempts == 1 {
+			return "", classifiedError{retryable: true}
+		}
+		return "backup.unf", nil
+	})
+	if err != nil || got != "backup.unf" {
+		t.Errorf("RetryValue() = %q, %v, want backup.unf", got, err)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		wantErr bool
+	}{
+		{"default", DefaultPolicy(3), false},
+		{"negative retries", Policy{MaxRetries: -1}, true},
+		{"shrinking multiplier", Policy{Multiplier: 0.5}, true},
+		{"unknown jitter", Policy{Jitter: "random"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := ParseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
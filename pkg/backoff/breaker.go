@@ -0,0 +1,137 @@
+package backoff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BreakerStatus is the state of a circuit breaker.
+type BreakerStatus string
+
+const (
+	// BreakerClosed lets every attempt through.
+	BreakerClosed BreakerStatus = "closed"
+	// BreakerOpen skips attempts until the cool-down has passed.
+	BreakerOpen BreakerStatus = "open"
+	// BreakerHalfOpen allows a single probe after the cool-down.
+	BreakerHalfOpen BreakerStatus = "half-open"
+)
+
+// BreakerState is the persisted state of a circuit breaker.
+type BreakerState struct {
+	// Failures is the number of consecutive failed runs
+	Failures int `json:"failures"`
+	// LastError describes the last failure
+	LastError string `json:"lastError,omitempty"`
+	// LastFailure and LastSuccess are the times of the last failed and
+	// successful runs
+	LastFailure time.Time `json:"lastFailure,omitzero"`
+	LastSuccess time.Time `json:"lastSuccess,omitzero"`
+	// OpenUntil is the end of the current cool-down
+	OpenUntil time.Time `json:"openUntil,omitzero"`
+}
+
+// Breaker stops attempts against a target that keeps failing across runs.
+//
+// After Threshold consecutive failures the breaker opens and Status reports
+// BreakerOpen for CoolDown. It then reports BreakerHalfOpen so that the
+// caller can probe the target; a failure while half-open opens the breaker
+// for another CoolDown, a success closes it.
+type Breaker struct {
+	// Threshold is the number of consecutive failures that opens the breaker
+	Threshold int
+	// CoolDown is how long the breaker stays open
+	CoolDown time.Duration
+	// Clock defaults to the real clock
+	Clock Clock
+	// State is read and updated by the breaker
+	State BreakerState
+}
+
+func (b *Breaker) now() time.Time {
+	if b.Clock == nil {
+		return time.Now()
+	}
+	return b.Clock.Now()
+}
+
+// Status returns the current state of the breaker.
+func (b *Breaker) Status() BreakerStatus {
+	if b.Threshold <= 0 || b.State.Failures < b.Threshold {
+		return BreakerClosed
+	}
+	if b.now().Before(b.State.OpenUntil) {
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// RecordSuccess closes the breaker.
+func (b *Breaker) RecordSuccess() {
+	b.State.Failures = 0
+	b.State.LastError = ""
+	b.State.LastSuccess = b.now()
+	b.State.OpenUntil = time.Time{}
+}
+
+// RecordFailure counts a failed run and opens the breaker once Threshold
+// consecutive runs have failed.
+func (b *Breaker) RecordFailure(err error) {
+	now := b.now()
+	b.State.Failures++
+	b.State.LastFailure = now
+	if err != nil {
+		b.State.LastError = err.Error()
+	}
+	if b.Threshold > 0 && b.State.Failures >= b.Threshold {
+		b.State.OpenUntil = now.Add(b.CoolDown)
+	}
+}
+
+// LoadBreakerStates reads the breaker states stored in the file at path,
+// keyed by target. A missing file yields an empty map.
+func LoadBreakerStates(path string) (map[string]BreakerState, error) {
+	states := make(map[string]BreakerState)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read breaker state: %w", err)
+	}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("decode breaker state %s: %w", path, err)
+	}
+	return states, nil
+}
+
+// SaveBreakerStates replaces the file at path with states. The file is
+// written to a temporary file first so that a crash cannot leave it
+// truncated.
+func SaveBreakerStates(path string, states map[string]BreakerState) error {
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode breaker state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("write breaker state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write breaker state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write breaker state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write breaker state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package backoff
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := &Breaker{Threshold: 3, CoolDown: time.Hour, Clock: clock}
+
+	for i := range 2 {
+		b.RecordFailure(errors.New("connection refused"))
+		if got := b.Status(); got != BreakerClosed {
+			t.Fatalf("after %d failures Status() = %s, want closed", i+1, got)
+		}
+	}
+	b.RecordFailure(errors.New("connection refused"))
+	if got := b.Status(); got != BreakerOpen {
+		t.Fatalf("Status() = %s, want open", got)
+	}
+	if !b.State.OpenUntil.Equal(clock.now.Add(time.Hour)) {
+		t.Errorf("OpenUntil = %v, want one hour after the last failure", b.State.OpenUntil)
+	}
+	if b.State.LastError != "connection refused" {
+		t.Errorf("LastError = %q", b.State.LastError)
+	}
+}
+
+func TestBreakerHalfOpenAfterCoolDown(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := &Breaker{Threshold: 1, CoolDown: time.Hour, Clock: clock}
+
+	b.RecordFailure(errors.New("timeout"))
+	clock.now = clock.now.Add(time.Hour)
+	if got := b.Status(); got != BreakerHalfOpen {
+		t.Fatalf("Status() = %s, want half-open", got)
+	}
+
+	// A failed probe opens the breaker for another cool-down
+	b.RecordFailure(errors.New("timeout"))
+	if got := b.Status(); got != BreakerOpen {
+		t.Fatalf("Status() after failed probe = %s, want open", got)
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	b.RecordSuccess()
+	if got := b.Status(); got != BreakerClosed || b.State.Failures != 0 || b.State.LastError != "" {
+		t.Errorf("after success Status() = %s, state = %+v", got, b.State)
+	}
+}
+
+func TestBreakerDisabledWithoutThreshold(t *testing.T) {
+	b := &Breaker{}
+	for range 10 {
+		b.RecordFailure(errors.New("down"))
+	}
+	if got := b.Status(); got != BreakerClosed {
+		t.Errorf("Status() = %s, want closed", got)
+	}
+}
+
+func TestBreakerStatesRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	states, err := LoadBreakerStates(path)
+	if err != nil || len(states) != 0 {
+		t.Fatalf("LoadBreakerStates() of missing file = %v, %v", states, err)
+	}
+
+	openUntil := time.Date(2025, 1, 1, 6, 0, 0, 0, time.UTC)
+	states["https://unifi.example.com"] = BreakerState{Failures: 5, LastError: "timeout", OpenUntil: openUntil}
+	if err := SaveBreakerStates(path, states); err != nil {
+		t.Fatalf("SaveBreakerStates() error = %v", err)
+	}
+
+	loaded, err := LoadBreakerStates(path)
+	if err != nil {
+		t.Fatalf("LoadBreakerStates() error = %v", err)
+	}
+	got := loaded["https://unifi.example.com"]
+	if got.Failures != 5 || got.LastError != "timeout" || !got.OpenUntil.Equal(openUntil) {
+		t.Errorf("loaded state = %+v", got)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"io"
 	"log/slog"
 	"os"
 	"strings"
@@ -9,7 +10,13 @@ import (
 	"github.com/Marlliton/slogpretty"
 )
 
+// SetupLogger installs the configured default logger, writing to stdout.
 func (cfg *Config) SetupLogger() {
+	cfg.SetupLoggerTo(os.Stdout)
+}
+
+// SetupLoggerTo installs the configured default logger, writing to w.
+func (cfg *Config) SetupLoggerTo(w io.Writer) {
 	// Setup structured logging based on config
 	logLevel, err := ParseSlogLevel(cfg.Logging.Level)
 	if err != nil {
@@ -19,11 +26,11 @@ func (cfg *Config) SetupLogger() {
 
 	var handler slog.Handler
 	if strings.EqualFold(cfg.Logging.Format, "json") {
-		handler = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})
+		handler = slog.NewJSONHandler(w, &slog.HandlerOptions{Level: logLevel})
 	} else if strings.EqualFold(cfg.Logging.Format, "text") {
-		handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})
+		handler = slog.NewTextHandler(w, &slog.HandlerOptions{Level: logLevel})
 	} else {
-		handler = slogpretty.New(os.Stdout, &slogpretty.Options{
+		handler = slogpretty.New(w, &slogpretty.Options{
 			Level:      logLevel,
 			TimeFormat: time.Kitchen,
 			Colorful:   true,
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// TestAzureBlobStoreRoundTrip runs against an Azurite-compatible emulator.
+//
+// Start one with:
+//
+//	docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+//
+// and set AZURITE_CONNECTION_STRING to the emulator connection string, e.g.
+// "UseDevelopmentStorage=true" or the full devstoreaccount1 string.
+func TestAzureBlobStoreRoundTrip(t *testing.T) {
+	connectionString := os.Getenv("AZURITE_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("AZURITE_CONNECTION_STRING not set; skipping Azure Blob Storage test")
+	}
+	t.Setenv("AZURE_STORAGE_CONNECTION_STRING", connectionString)
+
+	ctx := context.Background()
+	store, err := Open(ctx, "azblob://unifi-backup-test")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer store.Close()
+
+	// gocloud does not create containers, so create it through the SDK client
+	var client *container.Client
+	if !store.(*blobStore).b.As(&client) {
+		t.Fatal("expected bucket to expose *container.Client")
+	}
+	if _, err := client.Create(ctx, nil); err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		t.Fatalf("create container: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("unifi"), 10_000)
+	key := "unifi-backup-2025-01-01T00-00-00Z.unf"
+
+	written, err := store.Put(ctx, key, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if written != int64(len(data)) {
+		t.Errorf("Put() written = %d, want %d", written, len(data))
+	}
+
+	infos, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	found := false
+	for _, info := range infos {
+		if info.Key == key && info.Size == int64(len(data)) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("List() = %+v, missing %q", infos, key)
+	}
+
+	reader, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	got, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("read object: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Get() returned different content")
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Stat(ctx, key); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat() after delete error = %v, want ErrNotExist", err)
+	}
+}
@@ -2,41 +2,151 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
+	gcs "cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	azblobblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
 	"gocloud.dev/blob"
-	_ "gocloud.dev/blob/fileblob" // file://
-	_ "gocloud.dev/blob/gcsblob"  // gs://
-	_ "gocloud.dev/blob/s3blob"   // s3://
+	_ "gocloud.dev/blob/azureblob" // azblob://
+	_ "gocloud.dev/blob/fileblob"  // file://
+	_ "gocloud.dev/blob/gcsblob"   // gs://
+	_ "gocloud.dev/blob/s3blob"    // s3://
+	"gocloud.dev/gcerrors"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
 )
 
+// bucketPrefixSchemes are the blob URL schemes whose host is the bucket name,
+// so any URL path is used as a key prefix within the bucket
+var bucketPrefixSchemes = map[string]bool{
+	"s3":     true,
+	"gs":     true,
+	"azblob": true,
+}
+
 type blobStore struct {
 	b *blob.Bucket
+	// dir is the local directory of file:// buckets, which have no native
+	// preconditions and use O_EXCL lock files instead
+	dir string
+}
+
+// openBlobStore opens a gocloud bucket. For bucket-based schemes, a path in
+// the URL (e.g. s3://bucket/unifi/prod) restricts every operation to keys
+// below that prefix.
+func openBlobStore(ctx context.Context, storageURL string) (ObjectStore, error) {
+	bucketURL, prefix, err := splitBucketPrefix(storageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("open bucket %q: %w", bucketURL, err)
+	}
+	if prefix != "" {
+		b = blob.PrefixedBucket(b, prefix)
+	}
+	return &blobStore{b: b, dir: fileBucketDir(bucketURL)}, nil
+}
+
+// fileBucketDir returns the local directory of a file:// URL the same way
+// fileblob resolves it, or an empty string for other schemes
+func fileBucketDir(bucketURL string) string {
+	u, err := url.Parse(bucketURL)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	p := u.Path
+	// Host "." means a relative path
+	if u.Host == "." || os.PathSeparator != '/' {
+		p = strings.TrimPrefix(p, "/")
+	}
+	return filepath.FromSlash(p)
+}
+
+// splitBucketPrefix removes the path from bucket-based blob URLs and returns
+// it as a key prefix ending in "/". URLs of other schemes are returned
+// unchanged with an empty prefix.
+func splitBucketPrefix(storageURL string) (bucketURL, prefix string, err error) {
+	u, err := url.Parse(storageURL)
+	if err != nil || !bucketPrefixSchemes[u.Scheme] {
+		// Let gocloud report invalid URLs and handle other schemes
+		return storageURL, "", nil
+	}
+
+	prefix = strings.Trim(u.Path, "/")
+	if prefix == "" {
+		return storageURL, "", nil
+	}
+	if u.Query().Has("prefix") {
+		return "", "", fmt.Errorf("storage URL %q sets both a path and a prefix parameter", storageURL)
+	}
+
+	u.Path = ""
+	u.RawPath = ""
+	return u.String(), prefix + "/", nil
 }
 
 func (s *blobStore) Put(ctx context.Context, key string, r io.Reader) (written int64, err error) {
-	writer, err := s.b.NewWriter(ctx, key, nil)
+	// Cancelling the writer's context before Close aborts the upload, so a
+	// failed copy never leaves a truncated object behind
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer, err := s.b.NewWriter(writeCtx, key, nil)
 	if err != nil {
-		return 0, fmt.Errorf("create writer: %w", err)
+		return 0, fmt.Errorf("create writer: %w", classifyBlobError(err))
 	}
 
 	bytesWritten, err := io.Copy(writer, r)
 	if err != nil {
+		cancel()
 		_ = writer.Close()
 		return bytesWritten, fmt.Errorf("write data: %w", err)
 	}
 
 	if err := writer.Close(); err != nil {
-		return bytesWritten, fmt.Errorf("close writer: %w", err)
+		return bytesWritten, fmt.Errorf("close writer: %w", classifyBlobError(err))
 	}
 
 	return bytesWritten, nil
 }
 
-func (s *blobStore) List(ctx context.Context) ([]string, error) {
-	var backups []string
+func (s *blobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	reader, err := s.b.NewReader(ctx, key, nil)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, fmt.Errorf("open object %q: %w", key, ErrNotExist)
+		}
+		return nil, fmt.Errorf("open object %q: %w", key, err)
+	}
+	return reader, nil
+}
+
+func (s *blobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	attrs, err := s.b.Attributes(ctx, key)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return ObjectInfo{}, fmt.Errorf("stat object %q: %w", key, ErrNotExist)
+		}
+		return ObjectInfo{}, fmt.Errorf("stat object %q: %w", key, err)
+	}
+	return ObjectInfo{Key: key, Size: attrs.Size, ModTime: attrs.ModTime}, nil
+}
+
+func (s *blobStore) List(ctx context.Context) ([]ObjectInfo, error) {
+	var backups []ObjectInfo
 	iter := s.b.List(&blob.ListOptions{})
 	for {
 		obj, err := iter.Next(ctx)
@@ -46,9 +156,9 @@ func (s *blobStore) List(ctx context.Context) ([]string, error) {
 		if err != nil {
 			return nil, fmt.Errorf("iterate objects: %w", err)
 		}
-		// Filter for .unf files only
-		if strings.HasSuffix(obj.Key, ".unf") {
-			backups = append(backups, obj.Key)
+		// Filter for backups and their manifests only
+		if isBackupObject(obj.Key) {
+			backups = append(backups, ObjectInfo{Key: obj.Key, Size: obj.Size, ModTime: obj.ModTime})
 		}
 	}
 	return backups, nil
@@ -56,11 +166,125 @@ func (s *blobStore) List(ctx context.Context) ([]string, error) {
 
 func (s *blobStore) Delete(ctx context.Context, key string) error {
 	if err := s.b.Delete(ctx, key); err != nil {
-		return fmt.Errorf("delete object: %w", err)
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return fmt.Errorf("delete object %q: %w", key, ErrNotExist)
+		}
+		return fmt.Errorf("delete object: %w", classifyBlobError(err))
 	}
 	return nil
 }
 
+// classifyBlobError marks errors that retrying cannot fix, such as missing
+// permissions, as permanent
+func classifyBlobError(err error) error {
+	switch gcerrors.Code(err) {
+	case gcerrors.PermissionDenied, gcerrors.InvalidArgument, gcerrors.Unimplemented:
+		return backoff.Permanent(err)
+	}
+	return err
+}
+
 func (s *blobStore) Close() error {
 	return s.b.Close()
 }
+
+func (s *blobStore) getVersioned(ctx context.Context, key string) ([]byte, string, error) {
+	// Reading without the lock would race with a writer replacing the
+	// file and its attributes, which fileblob does not do atomically
+	if s.dir != "" {
+		return nil, "", errConditionalUnsupported
+	}
+
+	attrs, err := s.b.Attributes(ctx, key)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, "", fmt.Errorf("stat object %q: %w", key, ErrNotExist)
+		}
+		return nil, "", fmt.Errorf("stat object %q: %w", key, err)
+	}
+
+	// GCS preconditions use generations rather than ETags
+	version := attrs.ETag
+	var gcsAttrs gcs.ObjectAttrs
+	if attrs.As(&gcsAttrs) {
+		version = strconv.FormatInt(gcsAttrs.Generation, 10)
+	}
+
+	// If the object changes after the attributes were read, the version is
+	// outdated and the conditional write fails, so this cannot lose updates
+	data, err := s.b.ReadAll(ctx, key)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, "", fmt.Errorf("read object %q: %w", key, ErrNotExist)
+		}
+		return nil, "", fmt.Errorf("read object %q: %w", key, err)
+	}
+	return data, version, nil
+}
+
+func (s *blobStore) putIfVersion(ctx context.Context, key string, data []byte, version string) error {
+	if s.dir != "" {
+		return errConditionalUnsupported
+	}
+
+	opts := &blob.WriterOptions{IfNotExist: version == ""}
+	if version != "" {
+		opts.BeforeWrite = func(as func(any) bool) error {
+			var s3Input *transfermanager.UploadObjectInput
+			if as(&s3Input) {
+				s3Input.IfMatch = &version
+				return nil
+			}
+			var gcsObject **gcs.ObjectHandle
+			if as(&gcsObject) {
+				generation, err := strconv.ParseInt(version, 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid GCS generation %q: %w", version, err)
+				}
+				*gcsObject = (*gcsObject).If(gcs.Conditions{GenerationMatch: generation})
+				return nil
+			}
+			var azOptions *azblob.UploadStreamOptions
+			if as(&azOptions) {
+				etag := azcore.ETag(version)
+				azOptions.AccessConditions = &azblob.AccessConditions{
+					ModifiedAccessConditions: &azblobblob.ModifiedAccessConditions{IfMatch: &etag},
+				}
+				return nil
+			}
+			return errConditionalUnsupported
+		}
+	}
+
+	err := s.b.WriteAll(ctx, key, data, opts)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errConditionalUnsupported):
+		return errConditionalUnsupported
+	case gcerrors.Code(err) == gcerrors.FailedPrecondition:
+		return fmt.Errorf("write object %q: %w", key, ErrPreconditionFailed)
+	default:
+		return fmt.Errorf("write object %q: %w", key, err)
+	}
+}
+
+func (s *blobStore) createExclusive(ctx context.Context, key string, data []byte) error {
+	if s.dir == "" {
+		return s.putIfVersion(ctx, key, data, "")
+	}
+
+	// fileblob checks IfNotExist non-atomically, so create the file directly
+	f, err := os.OpenFile(filepath.Join(s.dir, filepath.FromSlash(key)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("create %q: %w", key, ErrPreconditionFailed)
+		}
+		return fmt.Errorf("create %q: %w", key, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write %q: %w", key, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/fileblob"
+)
+
+func TestSplitBucketPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		wantBucket string
+		wantPrefix string
+		wantErr    bool
+	}{
+		{
+			name:       "s3 bucket without path",
+			url:        "s3://my-bucket?region=us-east-1",
+			wantBucket: "s3://my-bucket?region=us-east-1",
+		},
+		{
+			name:       "s3 bucket with nested path",
+			url:        "s3://my-bucket/unifi/prod?region=us-east-1",
+			wantBucket: "s3://my-bucket?region=us-east-1",
+			wantPrefix: "unifi/prod/",
+		},
+		{
+			name:       "gs bucket with trailing slash",
+			url:        "gs://my-bucket/unifi/",
+			wantBucket: "gs://my-bucket",
+			wantPrefix: "unifi/",
+		},
+		{
+			name:       "azblob container with path",
+			url:        "azblob://backups/site-a",
+			wantBucket: "azblob://backups",
+			wantPrefix: "site-a/",
+		},
+		{
+			name:       "file URLs keep their path",
+			url:        "file://./backups/unifi",
+			wantBucket: "file://./backups/unifi",
+		},
+		{
+			name:    "path and prefix parameter",
+			url:     "s3://my-bucket/unifi?prefix=other/",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, prefix, err := splitBucketPrefix(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitBucketPrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if bucket != tt.wantBucket || prefix != tt.wantPrefix {
+				t.Errorf("splitBucketPrefix() = %q, %q, want %q, %q", bucket, prefix, tt.wantBucket, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestPrefixedBlobStoreIsolation(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// Objects written by other tools sharing the bucket
+	foreign := []string{
+		"unifi-backup-2024-01-01T00-00-00Z.unf",
+		filepath.Join("other-tool", "unifi-backup-2024-01-01T00-00-00Z.unf"),
+	}
+	for _, name := range foreign {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("foreign"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bucket, err := fileblob.OpenBucket(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &blobStore{b: blob.PrefixedBucket(bucket, "unifi/prod/")}
+	defer store.Close()
+
+	key := "unifi-backup-2025-01-01T00-00-00Z.unf"
+	if _, err := store.Put(ctx, key, strings.NewReader("ours")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unifi", "prod", key)); err != nil {
+		t.Errorf("expected backup below the prefix: %v", err)
+	}
+
+	infos, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(infos) != 1 || infos[0].Key != key {
+		t.Fatalf("List() = %+v, want only %q", infos, key)
+	}
+
+	if err := store.Delete(ctx, foreign[0]); err == nil {
+		t.Error("expected delete of a key outside the prefix to fail")
+	}
+	for _, name := range foreign {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("foreign object %q was touched: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"sort"
+	"time"
+)
+
+const (
+	// CatalogKey is the key of the catalog index at the root of a store
+	CatalogKey = "catalog.json"
+	// catalogLockKey guards catalog updates on stores without native
+	// conditional writes
+	catalogLockKey = CatalogKey + ".lock"
+	// catalogFormatVersion is the current catalog format
+	catalogFormatVersion = 1
+	// maxCatalogAttempts bounds how often a conflicting update is retried
+	maxCatalogAttempts = 10
+	// staleLockAge is how old a lock file must be before it is considered
+	// abandoned by a crashed run and removed
+	staleLockAge = 10 * time.Minute
+)
+
+// ErrPreconditionFailed is returned by conditional writes when the object was
+// changed by someone else since it was read, or when a lock is already held.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// errCatalogTooNew is returned when the catalog was written by a newer
+// version of the tool and must not be overwritten
+var errCatalogTooNew = errors.New("catalog format is newer than supported")
+
+// errConditionalUnsupported is returned by getVersioned or putIfVersion when
+// the backend has no native preconditions, in which case a lock file is used instead
+var errConditionalUnsupported = errors.New("conditional writes not supported")
+
+// conditionalStore is implemented by stores that support optimistic
+// concurrency through native preconditions (ETags or generations)
+type conditionalStore interface {
+	// getVersioned reads the object along with an opaque version token.
+	// Returns an error wrapping ErrNotExist if the object does not exist.
+	getVersioned(ctx context.Context, key string) ([]byte, string, error)
+	// putIfVersion writes the object only if its version still matches. An
+	// empty version requires that the object does not exist. Returns
+	// ErrPreconditionFailed if the object was modified concurrently.
+	putIfVersion(ctx context.Context, key string, data []byte, version string) error
+}
+
+// exclusiveCreator is implemented by stores that can atomically create an
+// object only if it does not exist yet, which is used for lock files
+type exclusiveCreator interface {
+	// createExclusive returns ErrPreconditionFailed if key already exists
+	createExclusive(ctx context.Context, key string, data []byte) error
+}
+
+// CatalogEntry describes a single backup in the catalog.
+type CatalogEntry struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Manifest is the backup manifest, if the backup has one
+	Manifest *Manifest `json:"manifest,omitempty"`
+}
+
+// Catalog is an index of the backups in a store, kept in CatalogKey so that
+// listing and retention do not need to walk the whole store.
+type Catalog struct {
+	FormatVersion int `json:"formatVersion"`
+	// UpdatedAt is the time of the last change to the catalog
+	UpdatedAt time.Time `json:"updatedAt"`
+	// ScannedAt is the time the catalog was last rebuilt from a full listing
+	ScannedAt time.Time      `json:"scannedAt"`
+	Backups   []CatalogEntry `json:"backups"`
+
+	// OrphanedManifests lists manifests without a backup. It is only set
+	// when the catalog was just rebuilt from a full listing.
+	OrphanedManifests []string `json:"-"`
+}
+
+// Stale reports whether the catalog has not been rebuilt from a full listing
+// within maxAge.
+func (c *Catalog) Stale(maxAge time.Duration, now time.Time) bool {
+	return c.ScannedAt.IsZero() || now.Sub(c.ScannedAt) > maxAge
+}
+
+// Put adds or replaces the entry for e.Key.
+func (c *Catalog) Put(e CatalogEntry) {
+	for i := range c.Backups {
+		if c.Backups[i].Key == e.Key {
+			c.Backups[i] = e
+			return
+		}
+	}
+	c.Backups = append(c.Backups, e)
+	sort.Slice(c.Backups, func(i, j int) bool { return c.Backups[i].Key < c.Backups[j].Key })
+}
+
+// SetManifest replaces the manifest of the entry for m.Key, if the catalog
+// has one.
+func (c *Catalog) SetManifest(m *Manifest) {
+	for i := range c.Backups {
+		if c.Backups[i].Key == m.Key {
+			c.Backups[i].Manifest = m
+			return
+		}
+	}
+}
+
+// Remove deletes the entries with the given keys.
+func (c *Catalog) Remove(keys ...string) {
+	remove := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		remove[key] = true
+	}
+	kept := c.Backups[:0]
+	for _, e := range c.Backups {
+		if !remove[e.Key] {
+			kept = append(kept, e)
+		}
+	}
+	c.Backups = kept
+}
+
+// ReadCatalog loads the catalog of store. Returns an error wrapping
+// ErrNotExist if the store has no catalog yet.
+func ReadCatalog(ctx context.Context, store ObjectStore) (*Catalog, error) {
+	reader, err := store.Get(ctx, CatalogKey)
+	if err != nil {
+		return nil, fmt.Errorf("read catalog: %w", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read catalog: %w", err)
+	}
+	return decodeCatalog(data)
+}
+
+// UpdateCatalog applies fn to the current catalog and writes the result.
+//
+// Updates are optimistic: the catalog is read, modified and written back with
+// a precondition (ETag or generation) on stores that support it, or while
+// holding a lock file otherwise. When another writer got there first, the
+// update is retried with the new catalog, so fn may be called more than once.
+func UpdateCatalog(ctx context.Context, store ObjectStore, fn func(*Catalog)) error {
+	var err error
+	for attempt := range maxCatalogAttempts {
+		if attempt > 0 {
+			// Back off with jitter so competing writers spread out
+			delay := time.Duration(50+rand.IntN(100*attempt)) * time.Millisecond
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		err = updateCatalogOnce(ctx, store, fn)
+		if !errors.Is(err, ErrPreconditionFailed) {
+			return err
+		}
+		slog.Debug("Catalog update conflicted; retrying", "attempt", attempt+1)
+	}
+	return fmt.Errorf("update catalog: giving up after %d attempts: %w", maxCatalogAttempts, err)
+}
+
+func updateCatalogOnce(ctx context.Context, store ObjectStore, fn func(*Catalog)) error {
+	if cs, ok := store.(conditionalStore); ok {
+		err := updateCatalogConditional(ctx, cs, fn)
+		if !errors.Is(err, errConditionalUnsupported) {
+			return err
+		}
+	}
+
+	unlock, err := lockCatalog(ctx, store)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var data []byte
+	reader, err := store.Get(ctx, CatalogKey)
+	switch {
+	case err == nil:
+		data, err = io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("read catalog: %w", err)
+		}
+	case !errors.Is(err, ErrNotExist):
+		return fmt.Errorf("read catalog: %w", err)
+	}
+
+	updated, err := applyCatalogUpdate(data, fn)
+	if err != nil {
+		return err
+	}
+	if _, err := store.Put(ctx, CatalogKey, bytes.NewReader(updated)); err != nil {
+		return fmt.Errorf("write catalog: %w", err)
+	}
+	return nil
+}
+
+// updateCatalogConditional updates the catalog with a conditional write. It
+// returns errConditionalUnsupported if the store must be locked instead.
+func updateCatalogConditional(ctx context.Context, cs conditionalStore, fn func(*Catalog)) error {
+	data, version, err := cs.getVersioned(ctx, CatalogKey)
+	switch {
+	case errors.Is(err, errConditionalUnsupported):
+		return err
+	case err != nil && !errors.Is(err, ErrNotExist):
+		return fmt.Errorf("read catalog: %w", err)
+	}
+	updated, err := applyCatalogUpdate(data, fn)
+	if err != nil {
+		return err
+	}
+	return cs.putIfVersion(ctx, CatalogKey, updated, version)
+}
+
+// applyCatalogUpdate decodes data (empty for a new catalog), applies fn and
+// returns the encoded result. A corrupt catalog is replaced by an empty,
+// stale one so the next listing rebuilds it.
+func applyCatalogUpdate(data []byte, fn func(*Catalog)) ([]byte, error) {
+	catalog := &Catalog{}
+	if len(data) > 0 {
+		decoded, err := decodeCatalog(data)
+		if errors.Is(err, errCatalogTooNew) {
+			return nil, err
+		}
+		if err != nil {
+			slog.Warn("Replacing unreadable catalog", "error", err)
+		} else {
+			catalog = decoded
+		}
+	}
+
+	fn(catalog)
+	catalog.FormatVersion = catalogFormatVersion
+	catalog.UpdatedAt = time.Now().UTC()
+
+	encoded, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal catalog: %w", err)
+	}
+	return encoded, nil
+}
+
+func decodeCatalog(data []byte) (*Catalog, error) {
+	var catalog Catalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("decode catalog: %w", err)
+	}
+	if catalog.FormatVersion > catalogFormatVersion {
+		return nil, fmt.Errorf("%w: version %d, supported %d", errCatalogTooNew, catalog.FormatVersion, catalogFormatVersion)
+	}
+	return &catalog, nil
+}
+
+// lockCatalog creates the catalog lock file, removing it first if it was
+// abandoned by a crashed run. Returns ErrPreconditionFailed if the lock is
+// held. Stores that cannot create objects exclusively are not locked.
+func lockCatalog(ctx context.Context, store ObjectStore) (unlock func(), err error) {
+	creator, ok := store.(exclusiveCreator)
+	if !ok {
+		slog.Debug("Store does not support lock files; updating catalog without a lock")
+		return func() {}, nil
+	}
+
+	lockData := []byte(time.Now().UTC().Format(time.RFC3339))
+	err = creator.createExclusive(ctx, catalogLockKey, lockData)
+	if errors.Is(err, ErrPreconditionFailed) {
+		info, statErr := store.Stat(ctx, catalogLockKey)
+		if statErr == nil && time.Since(info.ModTime) > staleLockAge {
+			slog.Warn("Removing stale catalog lock", "age", time.Since(info.ModTime).Round(time.Second))
+			if err := store.Delete(ctx, catalogLockKey); err != nil {
+				return nil, fmt.Errorf("remove stale catalog lock: %w", err)
+			}
+			err = creator.createExclusive(ctx, catalogLockKey, lockData)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrPreconditionFailed) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("lock catalog: %w", err)
+	}
+
+	return func() {
+		// Use a fresh context so the lock is released even after cancellation
+		if err := store.Delete(context.WithoutCancel(ctx), catalogLockKey); err != nil {
+			slog.Warn("Failed to release catalog lock", "error", err)
+		}
+	}, nil
+}
+
+// ScanCatalog builds a catalog from a full listing of store, reading the
+// manifest of every backup that has one.
+func ScanCatalog(ctx context.Context, store ObjectStore) (*Catalog, error) {
+	objects, err := store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list backups: %w", err)
+	}
+	backups, manifests := SplitManifests(objects)
+
+	catalog := &Catalog{
+		FormatVersion: catalogFormatVersion,
+		ScannedAt:     time.Now().UTC(),
+	}
+	for _, obj := range backups {
+		entry := CatalogEntry{Key: obj.Key, Size: obj.Size, ModTime: obj.ModTime}
+		if _, ok := manifests[obj.Key]; ok {
+			delete(manifests, obj.Key)
+			manifest, err := ReadManifest(ctx, store, obj.Key)
+			if err != nil {
+				slog.Debug("Ignoring unreadable manifest", "key", obj.Key, "error", err)
+			} else {
+				entry.Manifest = manifest
+			}
+		}
+		catalog.Backups = append(catalog.Backups, entry)
+	}
+	sort.Slice(catalog.Backups, func(i, j int) bool { return catalog.Backups[i].Key < catalog.Backups[j].Key })
+
+	for _, manifest := range manifests {
+		catalog.OrphanedManifests = append(catalog.OrphanedManifests, manifest.Key)
+	}
+	sort.Strings(catalog.OrphanedManifests)
+
+	return catalog, nil
+}
+
+// RebuildCatalog replaces the catalog of store with one built from a full
+// listing and returns it.
+func RebuildCatalog(ctx context.Context, store ObjectStore) (*Catalog, error) {
+	scanned, err := ScanCatalog(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeScannedCatalog(ctx, store, scanned); err != nil {
+		return nil, err
+	}
+	return scanned, nil
+}
+
+// writeScannedCatalog replaces the stored catalog with a scan result
+func writeScannedCatalog(ctx context.Context, store ObjectStore, scanned *Catalog) error {
+	return UpdateCatalog(ctx, store, func(c *Catalog) {
+		c.ScannedAt = scanned.ScannedAt
+		c.Backups = scanned.Backups
+	})
+}
+
+// LoadCatalog returns the backups in store, reading the catalog when it is
+// fresh and rebuilding it from a full listing when it is missing, unreadable
+// or has not been rescanned within maxAge. A maxAge of zero disables the
+// catalog and always scans without writing one.
+func LoadCatalog(ctx context.Context, store ObjectStore, maxAge time.Duration) (*Catalog, error) {
+	if maxAge <= 0 {
+		return ScanCatalog(ctx, store)
+	}
+
+	catalog, err := ReadCatalog(ctx, store)
+	switch {
+	case err == nil && !catalog.Stale(maxAge, time.Now()):
+		return catalog, nil
+	case err == nil:
+		slog.Info("Catalog is stale; rescanning store", "scanned_at", catalog.ScannedAt)
+	case errors.Is(err, ErrNotExist):
+		slog.Info("No catalog found; scanning store")
+	default:
+		slog.Warn("Failed to read catalog; scanning store", "error", err)
+	}
+
+	scanned, err := ScanCatalog(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeScannedCatalog(ctx, store, scanned); err != nil {
+		// The listing is still usable even if the catalog could not be saved
+		slog.Warn("Failed to save rebuilt catalog", "error", err)
+	}
+	return scanned, nil
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"gocloud.dev/blob/fileblob"
+)
+
+// versionedMemStore adds generation-based preconditions to memStore
+type versionedMemStore struct {
+	*memStore
+	versions map[string]int
+}
+
+func newVersionedMemStore() *versionedMemStore {
+	return &versionedMemStore{memStore: newMemStore(), versions: make(map[string]int)}
+}
+
+func (s *versionedMemStore) getVersioned(ctx context.Context, key string) ([]byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, "", ErrNotExist
+	}
+	return data, strconv.Itoa(s.versions[key]), nil
+}
+
+func (s *versionedMemStore) putIfVersion(ctx context.Context, key string, data []byte, version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.objects[key]
+	if (version == "" && exists) || (version != "" && version != strconv.Itoa(s.versions[key])) {
+		return ErrPreconditionFailed
+	}
+	s.objects[key] = data
+	s.versions[key]++
+	return nil
+}
+
+func TestUpdateCatalogConcurrentConditionalWrites(t *testing.T) {
+	testConcurrentCatalogUpdates(t, newVersionedMemStore())
+}
+
+func TestUpdateCatalogConcurrentWithLockFile(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &blobStore{b: bucket, dir: dir}
+	defer store.Close()
+
+	testConcurrentCatalogUpdates(t, store)
+
+	if _, err := os.Stat(filepath.Join(dir, catalogLockKey)); !os.IsNotExist(err) {
+		t.Errorf("expected lock file to be released, stat error = %v", err)
+	}
+}
+
+// testConcurrentCatalogUpdates checks that no update is lost when several
+// writers add entries at the same time
+func testConcurrentCatalogUpdates(t *testing.T, store ObjectStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprintf("unifi-backup-2025-01-%02dT00-00-00Z.unf", i+1)
+			errs <- UpdateCatalog(ctx, store, func(c *Catalog) { c.Put(CatalogEntry{Key: key, Size: int64(i)}) })
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("UpdateCatalog() error = %v", err)
+		}
+	}
+
+	catalog, err := ReadCatalog(ctx, store)
+	if err != nil {
+		t.Fatalf("ReadCatalog() error = %v", err)
+	}
+	if len(catalog.Backups) != writers {
+		t.Errorf("catalog has %d backups, want %d: %+v", len(catalog.Backups), writers, catalog.Backups)
+	}
+}
+
+func TestUpdateCatalogRemovesStaleLock(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &blobStore{b: bucket, dir: dir}
+	defer store.Close()
+
+	// Left behind by a crashed run
+	lockPath := filepath.Join(dir, catalogLockKey)
+	if err := os.WriteFile(lockPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	err = UpdateCatalog(ctx, store, func(c *Catalog) {
+		c.Put(CatalogEntry{Key: "unifi-backup-2025-01-01T00-00-00Z.unf"})
+	})
+	if err != nil {
+		t.Fatalf("UpdateCatalog() error = %v", err)
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	store.objects["unifi-backup-2025-01-01T00-00-00Z.unf"] = []byte("first")
+	store.objects["unifi-backup-2025-01-01T00-00-00Z.unf.json"] = []byte(`{"key":"unifi-backup-2025-01-01T00-00-00Z.unf","site":"default"}`)
+	store.objects["unifi-backup-2024-12-31T00-00-00Z.unf.json"] = []byte(`{}`)
+
+	// No catalog yet, so the store is scanned and the catalog written
+	catalog, err := LoadCatalog(ctx, store, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadCatalog() error = %v", err)
+	}
+	if len(catalog.Backups) != 1 || catalog.Backups[0].Manifest == nil || catalog.Backups[0].Manifest.Site != "default" {
+		t.Errorf("scanned catalog = %+v", catalog.Backups)
+	}
+	if len(catalog.OrphanedManifests) != 1 || catalog.OrphanedManifests[0] != "unifi-backup-2024-12-31T00-00-00Z.unf.json" {
+		t.Errorf("OrphanedManifests = %v", catalog.OrphanedManifests)
+	}
+	if _, ok := store.objects[CatalogKey]; !ok {
+		t.Fatal("expected catalog to be written")
+	}
+
+	// A fresh catalog is used without listing the store
+	store.objects["unifi-backup-2025-01-02T00-00-00Z.unf"] = []byte("second")
+	catalog, err = LoadCatalog(ctx, store, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadCatalog() error = %v", err)
+	}
+	if len(catalog.Backups) != 1 {
+		t.Errorf("expected catalog contents, got %+v", catalog.Backups)
+	}
+
+	// A stale catalog is rebuilt
+	err = UpdateCatalog(ctx, store, func(c *Catalog) { c.ScannedAt = time.Now().Add(-2 * time.Hour) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err = LoadCatalog(ctx, store, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadCatalog() error = %v", err)
+	}
+	if len(catalog.Backups) != 2 {
+		t.Errorf("expected rescanned catalog, got %+v", catalog.Backups)
+	}
+
+	// A disabled catalog always scans and never writes
+	delete(store.objects, CatalogKey)
+	if _, err := LoadCatalog(ctx, store, 0); err != nil {
+		t.Fatalf("LoadCatalog() error = %v", err)
+	}
+	if _, ok := store.objects[CatalogKey]; ok {
+		t.Error("disabled catalog was written")
+	}
+}
+
+func TestCatalogPutAndRemove(t *testing.T) {
+	var c Catalog
+	c.Put(CatalogEntry{Key: "b.unf", Size: 1})
+	c.Put(CatalogEntry{Key: "a.unf", Size: 1})
+	c.Put(CatalogEntry{Key: "b.unf", Size: 2})
+
+	if len(c.Backups) != 2 || c.Backups[0].Key != "a.unf" || c.Backups[1].Size != 2 {
+		t.Errorf("Put() = %+v", c.Backups)
+	}
+
+	c.SetManifest(&Manifest{Key: "b.unf", Site: "default"})
+	c.SetManifest(&Manifest{Key: "missing.unf"})
+	if c.Backups[1].Manifest == nil || c.Backups[1].Manifest.Site != "default" || len(c.Backups) != 2 {
+		t.Errorf("SetManifest() = %+v", c.Backups)
+	}
+
+	c.Remove("a.unf", "missing.unf")
+	if len(c.Backups) != 1 || c.Backups[0].Key != "b.unf" {
+		t.Errorf("Remove() = %+v", c.Backups)
+	}
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+)
+
+// fanOutBufferSize is the chunk size read from the source and written to
+// every destination
+const fanOutBufferSize = 32 * 1024
+
+// Destination is an ObjectStore that takes part in a fan-out upload.
+type Destination struct {
+	// Name identifies the destination in logs and results
+	Name string
+	// Store is the opened storage backend
+	Store ObjectStore
+	// Required marks the destination as mandatory; a failed upload to a
+	// best-effort destination is reported but does not fail the run
+	Required bool
+}
+
+// PutResult reports the outcome of a fan-out upload for one destination.
+type PutResult struct {
+	Name     string
+	Required bool
+	Written  int64
+	Err      error
+}
+
+// FanOut streams r to every destination concurrently so the source is read
+// exactly once.
+//
+// Each destination receives the data through its own io.Pipe and runs Put in
+// a separate goroutine with its own context. A destination that fails is
+// dropped from the stream and its context cancelled, while the remaining
+// destinations continue to receive data. Reading from r stops early only
+// when every destination has failed. When reading from r fails, every
+// context is cancelled so that no destination commits a truncated object.
+//
+// The returned results are in the same order as dests.
+func FanOut(ctx context.Context, key string, r io.Reader, dests []Destination) []PutResult {
+	results := make([]PutResult, len(dests))
+	writers := make([]*io.PipeWriter, len(dests))
+	cancels := make([]context.CancelFunc, len(dests))
+	// Pass a known length on through the pipes
+	size, sized := readerSize(r)
+
+	var wg sync.WaitGroup
+	for i, dest := range dests {
+		results[i] = PutResult{Name: dest.Name, Required: dest.Required}
+
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		putCtx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var src io.Reader = pr
+			if sized {
+				src = NewSizedReader(pr, size)
+			}
+			written, err := dest.Store.Put(putCtx, key, src)
+			results[i].Written = written
+			results[i].Err = err
+			// Unblock the writer if Put returned without draining the pipe
+			if err != nil {
+				_ = pr.CloseWithError(err)
+			} else {
+				_ = pr.Close()
+			}
+		}()
+	}
+
+	srcErr := fanOutCopy(writers, cancels, r, dests)
+
+	for i, pw := range writers {
+		if pw == nil {
+			continue
+		}
+		if srcErr != nil {
+			cancels[i]()
+			_ = pw.CloseWithError(srcErr)
+		} else {
+			_ = pw.Close()
+		}
+	}
+	wg.Wait()
+	for _, cancel := range cancels {
+		cancel()
+	}
+
+	for i := range results {
+		if srcErr != nil && results[i].Err == nil {
+			results[i].Err = fmt.Errorf("read source: %w", srcErr)
+		}
+	}
+
+	return results
+}
+
+// fanOutCopy copies r into every non-nil writer. Writers whose destination
+// failed are closed, their contexts cancelled, and set to nil. It returns
+// the first read error from r other than io.EOF.
+func fanOutCopy(writers []*io.PipeWriter, cancels []context.CancelFunc, r io.Reader, dests []Destination) error {
+	buf := make([]byte, fanOutBufferSize)
+	active := len(writers)
+
+	for active > 0 {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			for i, pw := range writers {
+				if pw == nil {
+					continue
+				}
+				if _, err := pw.Write(buf[:n]); err != nil {
+					slog.Warn("Dropping failed destination from upload", "destination", dests[i].Name, "error", err)
+					cancels[i]()
+					_ = pw.CloseWithError(err)
+					writers[i] = nil
+					active--
+				}
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	return nil
+}
+
+// RetryFailedUploads retries the destinations whose FanOut upload failed by
+// copying the backup from a destination that succeeded, so the source does
+// not have to be read again. Each destination gets up to policy.MaxRetries
+// more attempts, the failed FanOut upload counting as the first; errors that
+// backoff.IsRetryable rejects are left as they are.
+//
+// results is updated in place. Nothing is retried when every destination
+// failed.
+func RetryFailedUploads(ctx context.Context, key string, results []PutResult, dests []Destination, policy backoff.Policy) {
+	src := -1
+	for i, res := range results {
+		if res.Err == nil {
+			src = i
+			break
+		}
+	}
+	if src < 0 || policy.MaxRetries == 0 {
+		return
+	}
+	obj := ObjectInfo{Key: key, Size: results[src].Written}
+
+	var wg sync.WaitGroup
+	for i, dest := range dests {
+		if results[i].Err == nil || !backoff.IsRetryable(results[i].Err) {
+			continue
+		}
+		slog.Info("Retrying failed upload from another target",
+			"destination", dest.Name,
+			"source", dests[src].Name,
+			"error", results[i].Err,
+		)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := policy.WithMaxRetries(policy.MaxRetries-1).Retry(ctx, func() error {
+				return copyObject(ctx, dests[src].Store, dest.Store, obj, key, false)
+			})
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			results[i].Written = obj.Size
+			results[i].Err = nil
+		}()
+	}
+	wg.Wait()
+}
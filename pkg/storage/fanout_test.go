@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"gocloud.dev/blob/fileblob"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+)
+
+// memStore is an in-memory ObjectStore used by tests
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	failAt  int64    // fail Put after reading this many bytes (0 disables)
+	puts    []string // keys in the order they were written
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: make(map[string][]byte)}
+}
+
+func (s *memStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	var buf bytes.Buffer
+	var src io.Reader = r
+	if s.failAt > 0 {
+		src = io.LimitReader(r, s.failAt)
+	}
+	n, err := io.Copy(&buf, src)
+	if err != nil {
+		return n, err
+	}
+	if s.failAt > 0 {
+		return n, errors.New("simulated upload failure")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = buf.Bytes()
+	s.puts = append(s.puts, key)
+	return n, nil
+}
+
+func (s *memStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotExist
+	}
+	return ObjectInfo{Key: key, Size: int64(len(data))}, nil
+}
+
+func (s *memStore) List(ctx context.Context) ([]ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var infos []ObjectInfo
+	for k, data := range s.objects {
+		// Like the real stores, only list backups and manifests
+		if isBackupObject(k) {
+			infos = append(infos, ObjectInfo{Key: k, Size: int64(len(data))})
+		}
+	}
+	return infos, nil
+}
+
+func (s *memStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memStore) Close() error { return nil }
+
+func TestFanOutWritesToAllDestinations(t *testing.T) {
+	data := bytes.Repeat([]byte("unifi"), 50_000)
+	a, b := newMemStore(), newMemStore()
+
+	results := FanOut(context.Background(), "backup.unf", bytes.NewReader(data), []Destination{
+		{Name: "a", Store: a, Required: true},
+		{Name: "b", Store: b, Required: true},
+	})
+
+	for _, res := range results {
+		if res.Err != nil {
+			t.Fatalf("destination %s: unexpected error: %v", res.Name, res.Err)
+		}
+		if res.Written != int64(len(data)) {
+			t.Errorf("destination %s: written = %d, want %d", res.Name, res.Written, len(data))
+		}
+	}
+	if !bytes.Equal(a.objects["backup.unf"], data) || !bytes.Equal(b.objects["backup.unf"], data) {
+		t.Fatal("destination contents do not match source")
+	}
+}
+
+func TestFanOutContinuesWhenOneDestinationFails(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 200_000)
+	good, bad := newMemStore(), newMemStore()
+	bad.failAt = 1000
+
+	results := FanOut(context.Background(), "backup.unf", bytes.NewReader(data), []Destination{
+		{Name: "bad", Store: bad, Required: false},
+		{Name: "good", Store: good, Required: true},
+	})
+
+	if results[0].Err == nil {
+		t.Error("expected failing destination to report an error")
+	}
+	if results[0].Required {
+		t.Error("expected failing destination to be best-effort")
+	}
+	if results[1].Err != nil {
+		t.Fatalf("healthy destination failed: %v", results[1].Err)
+	}
+	if !bytes.Equal(good.objects["backup.unf"], data) {
+		t.Fatal("healthy destination did not receive the full backup")
+	}
+}
+
+func TestFanOutReportsSourceError(t *testing.T) {
+	src := io.MultiReader(strings.NewReader("partial"), errReader{errors.New("connection reset")})
+	store := newMemStore()
+
+	results := FanOut(context.Background(), "backup.unf", src, []Destination{{Name: "a", Store: store}})
+
+	if results[0].Err == nil {
+		t.Fatal("expected source error to be reported")
+	}
+	if _, ok := store.objects["backup.unf"]; ok {
+		t.Error("expected no object to be stored on source error")
+	}
+}
+
+func TestFanOutLeavesNoObjectWhenSourceFailsMidStream(t *testing.T) {
+	dir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &blobStore{b: bucket, dir: dir}
+	defer store.Close()
+
+	// Enough data that the writer has flushed part of it before the failure
+	partial := bytes.Repeat([]byte("unifi"), 200_000)
+	src := io.MultiReader(bytes.NewReader(partial), errReader{errors.New("connection reset")})
+
+	results := FanOut(context.Background(), "backup.unf", src, []Destination{{Name: "file", Store: store, Required: true}})
+	if results[0].Err == nil {
+		t.Fatal("expected source error to be reported")
+	}
+	if _, err := store.Stat(context.Background(), "backup.unf"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat() error = %v, want ErrNotExist for the truncated backup", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("unexpected file left behind: %s", entry.Name())
+	}
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestRetryFailedUploadsCopiesFromHealthyDestination(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100_000)
+	healthy := newMemStore()
+	flaky := &flakyStore{memStore: newMemStore(), failures: 1}
+	denied := &flakyStore{memStore: newMemStore(), failures: 10}
+	dests := []Destination{
+		{Name: "healthy", Store: healthy},
+		{Name: "flaky", Store: flaky},
+		{Name: "denied", Store: deniedStore{denied}},
+	}
+
+	results := FanOut(context.Background(), "backup.unf", bytes.NewReader(data), dests)
+	if results[1].Err == nil || results[2].Err == nil {
+		t.Fatalf("expected the first upload to fail: %+v", results)
+	}
+
+	RetryFailedUploads(context.Background(), "backup.unf", results, dests, backoff.Policy{MaxRetries: 2})
+
+	if results[1].Err != nil || !bytes.Equal(flaky.objects["backup.unf"], data) {
+		t.Errorf("flaky destination: err = %v, puts = %d", results[1].Err, flaky.puts)
+	}
+	if results[2].Err == nil || denied.puts != 1 {
+		t.Errorf("permanent failure was retried: err = %v, puts = %d", results[2].Err, denied.puts)
+	}
+}
+
+// deniedStore marks every failed Put as permanent
+type deniedStore struct {
+	*flakyStore
+}
+
+func (s deniedStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	n, err := s.flakyStore.Put(ctx, key, r)
+	return n, backoff.Permanent(err)
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// DefaultKeyTemplate is the key template for the flat
+// unifi-backup-<timestamp>.unf layout produced by GenerateBackupFilename
+const DefaultKeyTemplate = BackupPrefix + "{{.Timestamp}}" + BackupSuffix
+
+// unknownKeyValue replaces empty template fields so keys never contain
+// empty path segments
+const unknownKeyValue = "unknown"
+
+// KeyData holds the values available to key templates.
+type KeyData struct {
+	// Controller is the host name of the controller URL
+	Controller string
+	// Site is the UniFi site name
+	Site string
+	// Hostname is the console hostname reported by the controller
+	Hostname string
+	// Version is the UniFi Network application version
+	Version string
+	// Time is the backup time in UTC
+	Time time.Time
+	// Timestamp is Time formatted with TimeFormat
+	Timestamp string
+}
+
+// SameSource reports whether d, as parsed from a key or manifest, belongs to
+// the controller and site described by current. Fields the key layout does
+// not record are empty in d and match anything.
+func (d KeyData) SameSource(current KeyData) bool {
+	if d.Controller != "" && sanitizeKeyValue(d.Controller) != sanitizeKeyValue(current.Controller) {
+		return false
+	}
+	if d.Site != "" && sanitizeKeyValue(d.Site) != sanitizeKeyValue(current.Site) {
+		return false
+	}
+	return true
+}
+
+// keyFieldPatterns are the template fields that can be recovered from a key
+var keyFieldPatterns = map[string]string{
+	"Controller": `[^/]+?`,
+	"Site":       `[^/]+?`,
+	"Hostname":   `[^/]+?`,
+	"Version":    `[^/]+?`,
+	"Timestamp":  `\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}Z`,
+}
+
+// keyUnsafeChars are replaced in field values so they cannot create extra
+// path segments or names that SMB/Windows filesystems reject
+var keyUnsafeChars = strings.NewReplacer(
+	"/", "_", `\`, "_", ":", "_", "*", "_", "?", "_",
+	`"`, "_", "<", "_", ">", "_", "|", "_",
+)
+
+// KeyLayout generates and parses object keys from a text/template, e.g.
+//
+//	{{.Controller}}/{{.Site}}/{{.Time.Year}}/{{.Time.Format "01"}}/unifi-{{.Site}}-{{.Timestamp}}.unf
+//
+// The template must contain {{.Timestamp}} and end with ".unf" so that keys
+// can be listed and parsed back into their backup time. Actions other than
+// plain fields (such as {{.Time.Year}}) are matched but not captured when
+// parsing.
+type KeyLayout struct {
+	text string
+	tmpl *template.Template
+	re   *regexp.Regexp
+}
+
+// NewKeyLayout parses a key template.
+func NewKeyLayout(text string) (*KeyLayout, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse key template: %w", err)
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	captured := make(map[string]bool)
+	for _, node := range tmpl.Tree.Root.Nodes {
+		switch n := node.(type) {
+		case *parse.TextNode:
+			pattern.WriteString(regexp.QuoteMeta(string(n.Text)))
+		case *parse.ActionNode:
+			field := actionField(n)
+			fieldPattern, ok := keyFieldPatterns[field]
+			switch {
+			case ok && !captured[field]:
+				captured[field] = true
+				fmt.Fprintf(&pattern, "(?P<%s>%s)", field, fieldPattern)
+			case ok:
+				pattern.WriteString("(?:" + fieldPattern + ")")
+			default:
+				// Arbitrary actions such as {{.Time.Format "2006/01"}} may
+				// span several path segments
+				pattern.WriteString(`.+?`)
+			}
+		default:
+			return nil, fmt.Errorf("key template %q: unsupported template construct %q", text, node.String())
+		}
+	}
+	pattern.WriteString("$")
+
+	if !captured["Timestamp"] {
+		return nil, fmt.Errorf("key template %q must contain {{.Timestamp}}", text)
+	}
+	if !strings.HasSuffix(text, BackupSuffix) {
+		return nil, fmt.Errorf("key template %q must end with %s", text, BackupSuffix)
+	}
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("build key parser for %q: %w", text, err)
+	}
+
+	layout := &KeyLayout{text: text, tmpl: tmpl, re: re}
+
+	// Catch templates that fail at execution time (e.g. unknown fields) or
+	// that render keys the parser cannot read back
+	sample, err := layout.Key(KeyData{Time: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := layout.Parse(sample); err != nil {
+		return nil, fmt.Errorf("key template %q produces keys that cannot be parsed: %w", text, err)
+	}
+
+	return layout, nil
+}
+
+// actionField returns the field name for actions of the form {{.Field}}, or
+// an empty string for any other action
+func actionField(n *parse.ActionNode) string {
+	if len(n.Pipe.Decl) > 0 || len(n.Pipe.Cmds) != 1 || len(n.Pipe.Cmds[0].Args) != 1 {
+		return ""
+	}
+	field, ok := n.Pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	if !ok || len(field.Ident) != 1 {
+		return ""
+	}
+	return field.Ident[0]
+}
+
+// String returns the template text.
+func (l *KeyLayout) String() string {
+	return l.text
+}
+
+// Key renders the object key for data. Timestamp is derived from Time, and
+// empty string fields are replaced with "unknown".
+func (l *KeyLayout) Key(data KeyData) (string, error) {
+	data.Time = data.Time.UTC()
+	data.Timestamp = data.Time.Format(TimeFormat)
+	data.Controller = sanitizeKeyValue(data.Controller)
+	data.Site = sanitizeKeyValue(data.Site)
+	data.Hostname = sanitizeKeyValue(data.Hostname)
+	data.Version = sanitizeKeyValue(data.Version)
+
+	var buf bytes.Buffer
+	if err := l.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("render key template %q: %w", l.text, err)
+	}
+	return buf.String(), nil
+}
+
+// Parse extracts the key data from a key generated by this layout. Fields
+// that are not part of the template are left empty.
+//
+// Returns an error if the key does not match the layout or contains an
+// invalid timestamp.
+func (l *KeyLayout) Parse(key string) (KeyData, error) {
+	match := l.re.FindStringSubmatch(key)
+	if match == nil {
+		return KeyData{}, fmt.Errorf("key %q does not match layout %q", key, l.text)
+	}
+
+	var data KeyData
+	for i, name := range l.re.SubexpNames() {
+		switch name {
+		case "Controller":
+			data.Controller = match[i]
+		case "Site":
+			data.Site = match[i]
+		case "Hostname":
+			data.Hostname = match[i]
+		case "Version":
+			data.Version = match[i]
+		case "Timestamp":
+			data.Timestamp = match[i]
+		}
+	}
+
+	timestamp, err := time.Parse(TimeFormat, data.Timestamp)
+	if err != nil {
+		return KeyData{}, fmt.Errorf("failed to parse timestamp from key %q: %w", key, err)
+	}
+	data.Time = timestamp
+
+	return data, nil
+}
+
+// sanitizeKeyValue makes a template field value safe to use in a key
+func sanitizeKeyValue(v string) string {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return unknownKeyValue
+	}
+	return keyUnsafeChars.Replace(v)
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyLayoutRoundTrip(t *testing.T) {
+	ts := time.Date(2025, 3, 14, 15, 9, 26, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		template string
+		data     KeyData
+		wantKey  string
+		wantData KeyData
+	}{
+		{
+			name:     "default layout",
+			template: DefaultKeyTemplate,
+			data:     KeyData{Controller: "unifi.example.com", Site: "default", Time: ts},
+			wantKey:  "unifi-backup-2025-03-14T15-09-26Z.unf",
+			wantData: KeyData{Time: ts, Timestamp: "2025-03-14T15-09-26Z"},
+		},
+		{
+			name:     "nested layout",
+			template: `{{.Controller}}/{{.Site}}/{{.Time.Year}}/{{.Time.Format "01"}}/unifi-{{.Site}}-{{.Timestamp}}.unf`,
+			data:     KeyData{Controller: "unifi.example.com", Site: "branch-office", Time: ts},
+			wantKey:  "unifi.example.com/branch-office/2025/03/unifi-branch-office-2025-03-14T15-09-26Z.unf",
+			wantData: KeyData{Controller: "unifi.example.com", Site: "branch-office", Time: ts, Timestamp: "2025-03-14T15-09-26Z"},
+		},
+		{
+			name:     "hostname and version with unsafe characters",
+			template: "{{.Hostname}}/{{.Version}}/{{.Timestamp}}.unf",
+			data:     KeyData{Hostname: "UDM Pro", Version: "9.0/beta", Time: ts},
+			wantKey:  "UDM Pro/9.0_beta/2025-03-14T15-09-26Z.unf",
+			wantData: KeyData{Hostname: "UDM Pro", Version: "9.0_beta", Time: ts, Timestamp: "2025-03-14T15-09-26Z"},
+		},
+		{
+			name:     "action spanning path segments",
+			template: `{{.Time.Format "2006/01/02"}}/unifi-{{.Timestamp}}.unf`,
+			data:     KeyData{Time: ts},
+			wantKey:  "2025/03/14/unifi-2025-03-14T15-09-26Z.unf",
+			wantData: KeyData{Time: ts, Timestamp: "2025-03-14T15-09-26Z"},
+		},
+		{
+			name:     "missing values",
+			template: "{{.Hostname}}/{{.Timestamp}}.unf",
+			data:     KeyData{Time: ts},
+			wantKey:  "unknown/2025-03-14T15-09-26Z.unf",
+			wantData: KeyData{Hostname: "unknown", Time: ts, Timestamp: "2025-03-14T15-09-26Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := NewKeyLayout(tt.template)
+			if err != nil {
+				t.Fatalf("NewKeyLayout() error = %v", err)
+			}
+
+			key, err := layout.Key(tt.data)
+			if err != nil {
+				t.Fatalf("Key() error = %v", err)
+			}
+			if key != tt.wantKey {
+				t.Errorf("Key() = %q, want %q", key, tt.wantKey)
+			}
+
+			got, err := layout.Parse(key)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got != tt.wantData {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestNewKeyLayoutRejectsInvalidTemplates(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+	}{
+		{name: "syntax error", template: "{{.Site}/{{.Timestamp}}.unf"},
+		{name: "missing timestamp", template: "{{.Site}}/backup.unf"},
+		{name: "missing suffix", template: "{{.Site}}/{{.Timestamp}}.zip"},
+		{name: "unknown field", template: "{{.Region}}/{{.Timestamp}}.unf"},
+		{name: "conditionals", template: "{{if .Site}}{{.Site}}/{{end}}{{.Timestamp}}.unf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeyLayout(tt.template); err == nil {
+				t.Errorf("NewKeyLayout(%q) expected error", tt.template)
+			}
+		})
+	}
+}
+
+func TestKeyLayoutParseRejectsOtherKeys(t *testing.T) {
+	layout, err := NewKeyLayout("{{.Site}}/unifi-{{.Timestamp}}.unf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{
+		"unifi-backup-2025-01-01T00-00-00Z.unf",
+		"default/nested/unifi-2025-01-01T00-00-00Z.unf",
+		"default/unifi-2025-13-01T00-00-00Z.unf",
+		"default/unifi-latest.unf",
+	}
+	for _, key := range keys {
+		if _, err := layout.Parse(key); err == nil {
+			t.Errorf("Parse(%q) expected error", key)
+		}
+	}
+}
+
+func TestKeyDataSameSource(t *testing.T) {
+	current := KeyData{Controller: "unifi.example.com", Site: "default"}
+
+	tests := []struct {
+		name   string
+		parsed KeyData
+		want   bool
+	}{
+		{name: "layout without source fields", parsed: KeyData{}, want: true},
+		{name: "same controller and site", parsed: KeyData{Controller: "unifi.example.com", Site: "default"}, want: true},
+		{name: "other site", parsed: KeyData{Controller: "unifi.example.com", Site: "branch"}, want: false},
+		{name: "other controller", parsed: KeyData{Controller: "10.0.0.1", Site: "default"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.parsed.SameSource(current); got != tt.want {
+				t.Errorf("SameSource() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ManifestSuffix is appended to a backup key to form the key of its manifest
+const ManifestSuffix = ".json"
+
+// maxManifestSize bounds how much of a manifest object is read
+const maxManifestSize = 1 << 20
+
+// Manifest describes a stored backup. It is written next to the backup as
+// <key>.json once the upload has completed.
+type Manifest struct {
+	// Key is the object key of the backup
+	Key string `json:"key"`
+	// RunID identifies the run that created the backup
+	RunID string `json:"runId"`
+	// CreatedAt is the time the backup was taken
+	CreatedAt time.Time `json:"createdAt"`
+	// ControllerURL is the configured controller URL
+	ControllerURL string `json:"controllerUrl"`
+	// Hostname is the console hostname reported by the controller
+	Hostname string `json:"hostname,omitempty"`
+	// Site is the UniFi site name
+	Site string `json:"site"`
+	// Version is the UniFi Network application version
+	Version string `json:"version,omitempty"`
+	// Model is the console hardware model reported by UniFi OS
+	Model string `json:"model,omitempty"`
+	// UptimeSeconds is how long the Network application had been running
+	// when the backup was taken
+	UptimeSeconds int64 `json:"uptimeSeconds,omitempty"`
+	// IncludeDays is the number of days of history included in the backup
+	IncludeDays int `json:"includeDays"`
+	// Size is the backup size in bytes
+	Size int64 `json:"size"`
+	// SHA256 is the hex-encoded SHA-256 checksum of the backup
+	SHA256 string `json:"sha256"`
+	// DurationSeconds is how long the run took from login to upload
+	DurationSeconds float64 `json:"durationSeconds"`
+	// ToolVersion and ToolCommit identify the unifi-backup build
+	ToolVersion string `json:"toolVersion"`
+	ToolCommit  string `json:"toolCommit"`
+	// Verification is the result of the last restore test, if any
+	Verification *Verification `json:"verification,omitempty"`
+}
+
+// Verification records the result of a restore test of a backup.
+type Verification struct {
+	// VerifiedAt is the time of the restore test
+	VerifiedAt time.Time `json:"verifiedAt"`
+	// OK reports whether the backup passed
+	OK bool `json:"ok"`
+	// Error describes why the backup failed
+	Error string `json:"error,omitempty"`
+}
+
+// Verified reports whether the backup passed its last restore test.
+func (m *Manifest) Verified() bool {
+	return m != nil && m.Verification != nil && m.Verification.OK
+}
+
+// KeyData returns the key template fields recorded in the manifest.
+func (m *Manifest) KeyData() KeyData {
+	controller := m.ControllerURL
+	if u, err := url.Parse(m.ControllerURL); err == nil && u.Hostname() != "" {
+		controller = u.Hostname()
+	}
+	return KeyData{
+		Controller: controller,
+		Site:       m.Site,
+		Hostname:   m.Hostname,
+		Version:    m.Version,
+		Time:       m.CreatedAt,
+		Timestamp:  m.CreatedAt.UTC().Format(TimeFormat),
+	}
+}
+
+// ManifestKey returns the key of the manifest for the given backup key.
+func ManifestKey(backupKey string) string {
+	return backupKey + ManifestSuffix
+}
+
+// IsManifestKey reports whether key names a backup manifest.
+func IsManifestKey(key string) bool {
+	return strings.HasSuffix(key, BackupSuffix+ManifestSuffix)
+}
+
+// isBackupObject reports whether name is a backup or a backup manifest, i.e.
+// an object that List should return
+func isBackupObject(name string) bool {
+	return strings.HasSuffix(name, BackupSuffix) || IsManifestKey(name)
+}
+
+// SplitManifests separates the result of List into backups and manifests.
+// The manifests are keyed by the key of the backup they describe, and may
+// include orphans whose backup no longer exists.
+func SplitManifests(objects []ObjectInfo) (backups []ObjectInfo, manifests map[string]ObjectInfo) {
+	manifests = make(map[string]ObjectInfo)
+	for _, obj := range objects {
+		if IsManifestKey(obj.Key) {
+			manifests[strings.TrimSuffix(obj.Key, ManifestSuffix)] = obj
+			continue
+		}
+		backups = append(backups, obj)
+	}
+	return backups, manifests
+}
+
+// WriteManifest stores m next to the backup it describes.
+func WriteManifest(ctx context.Context, store ObjectStore, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	if _, err := store.Put(ctx, ManifestKey(m.Key), bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("write manifest for %q: %w", m.Key, err)
+	}
+	return nil
+}
+
+// ReadManifest loads the manifest of the given backup. Returns an error
+// wrapping ErrNotExist if the backup has no manifest.
+func ReadManifest(ctx context.Context, store ObjectStore, backupKey string) (*Manifest, error) {
+	reader, err := store.Get(ctx, ManifestKey(backupKey))
+	if err != nil {
+		return nil, fmt.Errorf("read manifest for %q: %w", backupKey, err)
+	}
+	defer reader.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(io.LimitReader(reader, maxManifestSize)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decode manifest for %q: %w", backupKey, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+
+	key := "unifi-backup-2025-01-01T00-00-00Z.unf"
+	want := &Manifest{
+		Key:           key,
+		RunID:         "0123456789abcdef",
+		CreatedAt:     time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		ControllerURL: "https://unifi.example.com",
+		Hostname:      "UDM-Pro",
+		Site:          "default",
+		Version:       "9.0.114",
+		Model:         "UDMPRO",
+		UptimeSeconds: 86400,
+		Size:          1024,
+		SHA256:        "abc123",
+		ToolVersion:   "v1.2.3",
+		ToolCommit:    "deadbeef",
+	}
+	if err := WriteManifest(ctx, store, want); err != nil {
+		t.Fatalf("WriteManifest() error = %v", err)
+	}
+	if _, ok := store.objects[key+".json"]; !ok {
+		t.Fatalf("expected manifest at %q", key+".json")
+	}
+
+	got, err := ReadManifest(ctx, store, key)
+	if err != nil {
+		t.Fatalf("ReadManifest() error = %v", err)
+	}
+	if *got != *want {
+		t.Errorf("ReadManifest() = %+v, want %+v", got, want)
+	}
+
+	data := got.KeyData()
+	if data.Controller != "unifi.example.com" || data.Site != "default" || data.Timestamp != "2025-01-01T00-00-00Z" {
+		t.Errorf("KeyData() = %+v", data)
+	}
+
+	if _, err := ReadManifest(ctx, store, "unifi-backup-2025-01-02T00-00-00Z.unf"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("ReadManifest() for missing manifest error = %v, want ErrNotExist", err)
+	}
+}
+
+func TestSplitManifests(t *testing.T) {
+	objects := []ObjectInfo{
+		{Key: "unifi-backup-2025-01-01T00-00-00Z.unf"},
+		{Key: "unifi-backup-2025-01-01T00-00-00Z.unf.json"},
+		{Key: "site/unifi-backup-2025-01-02T00-00-00Z.unf"},
+		// Orphaned manifest whose backup was deleted
+		{Key: "unifi-backup-2024-12-31T00-00-00Z.unf.json"},
+	}
+
+	backups, manifests := SplitManifests(objects)
+	if len(backups) != 2 {
+		t.Errorf("backups = %+v, want 2 entries", backups)
+	}
+	if len(manifests) != 2 {
+		t.Errorf("manifests = %+v, want 2 entries", manifests)
+	}
+	if m, ok := manifests["unifi-backup-2025-01-01T00-00-00Z.unf"]; !ok || m.Key != "unifi-backup-2025-01-01T00-00-00Z.unf.json" {
+		t.Errorf("manifest for backup not found: %+v", manifests)
+	}
+	if _, ok := manifests["unifi-backup-2024-12-31T00-00-00Z.unf"]; !ok {
+		t.Error("orphaned manifest not returned")
+	}
+}
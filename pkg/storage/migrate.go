@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// MigrateOptions configures MigrateKeys.
+type MigrateOptions struct {
+	// Defaults provides values for template fields that the source layout
+	// does not record, e.g. the controller and site when migrating from the
+	// flat default layout
+	Defaults KeyData
+	// DryRun logs the planned renames without copying or deleting anything
+	DryRun bool
+}
+
+// MigrateResult summarizes the outcome of MigrateKeys.
+type MigrateResult struct {
+	Migrated int
+	Skipped  int
+	Failed   int
+}
+
+// MigrateKeys renames the backups in store from the from layout to the to
+// layout.
+//
+// Object stores have no rename, so each backup is copied to its new key,
+// verified by SHA-256 checksum and only then deleted from the old key. Keys
+// that do not match the from layout are left alone. When the new key already
+// exists with the same size (e.g. after an interrupted migration) only the
+// old key is deleted. Manifests move with their backup, and the fields they
+// record take precedence over opts.Defaults.
+//
+// Individual failures are counted in the result and do not stop the
+// remaining renames. The returned error is only set when the store cannot be
+// listed or the context is cancelled.
+func MigrateKeys(ctx context.Context, store ObjectStore, from, to *KeyLayout, opts MigrateOptions) (MigrateResult, error) {
+	var result MigrateResult
+
+	objects, err := store.List(ctx)
+	if err != nil {
+		return result, fmt.Errorf("list backups: %w", err)
+	}
+	existing := make(map[string]ObjectInfo, len(objects))
+	for _, obj := range objects {
+		existing[obj.Key] = obj
+	}
+
+	backups, manifests := SplitManifests(objects)
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Key < backups[j].Key })
+
+	for _, obj := range backups {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		data, err := from.Parse(obj.Key)
+		if err != nil {
+			slog.Debug("Skipping key that does not match the source layout", "key", obj.Key)
+			result.Skipped++
+			continue
+		}
+
+		// Manifests record the fields flat layouts lack
+		var manifest *Manifest
+		if _, ok := manifests[obj.Key]; ok {
+			manifest, err = ReadManifest(ctx, store, obj.Key)
+			if err != nil {
+				slog.Warn("Ignoring unreadable manifest", "key", obj.Key, "error", err)
+				manifest = nil
+			} else {
+				data = fillKeyData(data, manifest.KeyData())
+			}
+		}
+		data = fillKeyData(data, opts.Defaults)
+
+		newKey, err := to.Key(data)
+		if err != nil {
+			slog.Warn("Failed to generate new key", "key", obj.Key, "error", err)
+			result.Failed++
+			continue
+		}
+		if newKey == obj.Key {
+			result.Skipped++
+			continue
+		}
+
+		if opts.DryRun {
+			slog.Info("Would migrate backup", "from", obj.Key, "to", newKey)
+			result.Migrated++
+			continue
+		}
+
+		if dstObj, ok := existing[newKey]; ok {
+			if dstObj.Size != obj.Size {
+				slog.Warn("Refusing to overwrite a different backup at the new key",
+					"from", obj.Key,
+					"to", newKey,
+					"size", obj.Size,
+					"existing_size", dstObj.Size,
+				)
+				result.Failed++
+				continue
+			}
+		} else if err := copyObject(ctx, store, store, obj, newKey, true); err != nil {
+			slog.Warn("Failed to copy backup to new key", "from", obj.Key, "to", newKey, "error", err)
+			result.Failed++
+			continue
+		}
+
+		if manifest != nil {
+			manifest.Key = newKey
+			if err := WriteManifest(ctx, store, manifest); err != nil {
+				slog.Warn("Failed to write manifest for new key", "key", newKey, "error", err)
+				result.Failed++
+				continue
+			}
+		}
+
+		if err := store.Delete(ctx, obj.Key); err != nil {
+			slog.Warn("Failed to delete old key after copy", "key", obj.Key, "error", err)
+			result.Failed++
+			continue
+		}
+		if manifest != nil {
+			if err := store.Delete(ctx, ManifestKey(obj.Key)); err != nil {
+				slog.Warn("Failed to delete old manifest", "key", ManifestKey(obj.Key), "error", err)
+			}
+		}
+		existing[newKey] = ObjectInfo{Key: newKey, Size: obj.Size, ModTime: obj.ModTime}
+		slog.Info("Migrated backup", "from", obj.Key, "to", newKey)
+		result.Migrated++
+	}
+
+	return result, nil
+}
+
+// fillKeyData sets the empty string fields of data from defaults
+func fillKeyData(data, defaults KeyData) KeyData {
+	if data.Controller == "" {
+		data.Controller = defaults.Controller
+	}
+	if data.Site == "" {
+		data.Site = defaults.Site
+	}
+	if data.Hostname == "" {
+		data.Hostname = defaults.Hostname
+	}
+	if data.Version == "" {
+		data.Version = defaults.Version
+	}
+	return data
+}
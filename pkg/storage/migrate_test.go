@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMigrateKeys(t *testing.T) {
+	from, err := NewKeyLayout(DefaultKeyTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := NewKeyLayout("{{.Controller}}/{{.Site}}/{{.Time.Year}}/unifi-{{.Timestamp}}.unf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := newMemStore()
+	store.objects["unifi-backup-2024-12-31T00-00-00Z.unf"] = []byte("old")
+	store.objects["unifi-backup-2025-01-01T00-00-00Z.unf"] = []byte("new")
+	store.objects["notes.unf"] = []byte("unrelated")
+	// Left behind by an interrupted migration
+	store.objects["unifi-backup-2025-01-02T00-00-00Z.unf"] = []byte("copied")
+	store.objects["ctrl/default/2025/unifi-2025-01-02T00-00-00Z.unf"] = []byte("copied")
+
+	opts := MigrateOptions{Defaults: KeyData{Controller: "ctrl", Site: "default"}}
+	result, err := MigrateKeys(context.Background(), store, from, to, opts)
+	if err != nil {
+		t.Fatalf("MigrateKeys() error = %v", err)
+	}
+
+	if result.Migrated != 3 || result.Failed != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	want := map[string]string{
+		"ctrl/default/2024/unifi-2024-12-31T00-00-00Z.unf": "old",
+		"ctrl/default/2025/unifi-2025-01-01T00-00-00Z.unf": "new",
+		"ctrl/default/2025/unifi-2025-01-02T00-00-00Z.unf": "copied",
+		"notes.unf": "unrelated",
+	}
+	if len(store.objects) != len(want) {
+		t.Errorf("store contains %d objects, want %d: %v", len(store.objects), len(want), store.objects)
+	}
+	for key, data := range want {
+		if string(store.objects[key]) != data {
+			t.Errorf("object %q = %q, want %q", key, store.objects[key], data)
+		}
+	}
+}
+
+func TestMigrateKeysDryRunChangesNothing(t *testing.T) {
+	from, _ := NewKeyLayout(DefaultKeyTemplate)
+	to, _ := NewKeyLayout("{{.Site}}/{{.Timestamp}}.unf")
+
+	store := newMemStore()
+	store.objects["unifi-backup-2025-01-01T00-00-00Z.unf"] = []byte("data")
+
+	result, err := MigrateKeys(context.Background(), store, from, to, MigrateOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("MigrateKeys() error = %v", err)
+	}
+	if result.Migrated != 1 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if _, ok := store.objects["unifi-backup-2025-01-01T00-00-00Z.unf"]; !ok || len(store.objects) != 1 {
+		t.Errorf("dry run modified store: %v", store.objects)
+	}
+}
+
+func TestMigrateKeysMovesManifests(t *testing.T) {
+	ctx := context.Background()
+	from, _ := NewKeyLayout(DefaultKeyTemplate)
+	to, _ := NewKeyLayout("{{.Hostname}}/{{.Site}}/{{.Timestamp}}.unf")
+
+	store := newMemStore()
+	oldKey := "unifi-backup-2025-01-01T00-00-00Z.unf"
+	store.objects[oldKey] = []byte("data")
+	if err := WriteManifest(ctx, store, &Manifest{Key: oldKey, Site: "branch", Hostname: "UDM-Pro"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest takes precedence over the configured defaults
+	opts := MigrateOptions{Defaults: KeyData{Site: "default"}}
+	result, err := MigrateKeys(ctx, store, from, to, opts)
+	if err != nil {
+		t.Fatalf("MigrateKeys() error = %v", err)
+	}
+	if result.Migrated != 1 || result.Failed != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	newKey := "UDM-Pro/branch/2025-01-01T00-00-00Z.unf"
+	if string(store.objects[newKey]) != "data" {
+		t.Fatalf("backup not moved to %q: %v", newKey, store.objects)
+	}
+	manifest, err := ReadManifest(ctx, store, newKey)
+	if err != nil {
+		t.Fatalf("ReadManifest() error = %v", err)
+	}
+	if manifest.Key != newKey {
+		t.Errorf("manifest key = %q, want %q", manifest.Key, newKey)
+	}
+	if len(store.objects) != 2 {
+		t.Errorf("old objects left behind: %v", store.objects)
+	}
+}
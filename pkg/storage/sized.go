@@ -0,0 +1,50 @@
+package storage
+
+import "io"
+
+// sizedReader is a reader whose total length is known in advance. Stores
+// that must announce the length of an upload, such as WebDAV, read it with
+// readerSize.
+type sizedReader struct {
+	r    io.Reader
+	size int64
+}
+
+// NewSizedReader returns a reader over r that reports size, the number of
+// bytes r yields, e.g. from a Content-Length header, to the stores it is
+// uploaded to. A negative size means unknown and returns r as is.
+func NewSizedReader(r io.Reader, size int64) io.Reader {
+	if size < 0 {
+		return r
+	}
+	return &sizedReader{r: r, size: size}
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// readerSize returns the number of bytes left in r, if r can tell without
+// being read
+func readerSize(r io.Reader) (int64, bool) {
+	switch r := r.(type) {
+	case *sizedReader:
+		return r.size, true
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	case io.Seeker:
+		current, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, false
+		}
+		if _, err := r.Seek(current, io.SeekStart); err != nil {
+			return 0, false
+		}
+		return end - current, true
+	}
+	return 0, false
+}
@@ -2,25 +2,106 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/jfjallid/go-smb/smb"
 	"github.com/jfjallid/go-smb/spnego"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
 )
 
 type smbStore struct {
+	// mu guards session, which is replaced after a connection failure
+	mu       sync.Mutex
 	session  *smb.Connection
+	options  smb.Options
 	share    string
 	basePath string
 }
 
+// conn returns the SMB session, reconnecting if a previous operation found
+// the connection broken
+func (s *smbStore) conn() (*smb.Connection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session != nil {
+		return s.session, nil
+	}
+
+	slog.Info("Reconnecting to SMB server", "host", s.options.Host, "share", s.share)
+	session, err := dialSMB(s.options, s.share)
+	if err != nil {
+		return nil, err
+	}
+	s.session = session
+	return session, nil
+}
+
+// checkErr classifies an error returned by session. Connection and session
+// failures drop the session so the next operation, e.g. a retry, reconnects.
+// Permission and logon failures are marked permanent.
+func (s *smbStore) checkErr(session *smb.Connection, err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, status := range smbPermanentStatuses {
+		if err == smb.StatusMap[status] {
+			return backoff.Permanent(err)
+		}
+	}
+	if isSMBConnectionError(err) {
+		s.mu.Lock()
+		if s.session == session {
+			session.Close()
+			s.session = nil
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// smbPermanentStatuses are SMB statuses that retrying cannot fix
+var smbPermanentStatuses = []uint32{
+	smb.StatusAccessDenied,
+	smb.StatusLogonFailure,
+	smb.StatusAccountRestriction,
+	smb.StatusAccountDisabled,
+	smb.StatusAccountLockedOut,
+	smb.StatusPasswordExpired,
+	smb.StatusPasswordMustChange,
+	smb.StatusBadNetworkName,
+}
+
+// isSMBConnectionError reports whether err means the TCP connection or the
+// SMB session is gone and a new one is needed
+func isSMBConnectionError(err error) bool {
+	if err == smb.StatusMap[smb.StatusUserSessionDeleted] || err == smb.StatusMap[smb.StatusNetworkNameDeleted] {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
 func (s *smbStore) Put(ctx context.Context, key string, r io.Reader) (written int64, err error) {
 	fullPath := path.Join(s.basePath, key)
+	session, err := s.conn()
+	if err != nil {
+		return 0, err
+	}
 
 	// Ensure the parent directory exists
 	dir := path.Dir(fullPath)
@@ -29,7 +110,7 @@ func (s *smbStore) Put(ctx context.Context, key string, r io.Reader) (written in
 		// MkdirAll is idempotent - it succeeds if the directory already exists
 		// We only log non-critical errors since the subsequent PutFile will fail
 		// if there's a real permission issue
-		if err := s.session.MkdirAll(s.share, dir); err != nil {
+		if err := session.MkdirAll(s.share, dir); err != nil {
 			// Check if the error is because the directory already exists
 			// The go-smb library returns STATUS_OBJECT_NAME_COLLISION for existing dirs
 			if !strings.Contains(err.Error(), "COLLISION") && !strings.Contains(err.Error(), "exists") {
@@ -42,48 +123,147 @@ func (s *smbStore) Put(ctx context.Context, key string, r io.Reader) (written in
 	// Use PutFile with a callback that reads from the reader
 	const offset = uint64(0)
 	bytesWritten := int64(0)
-	err = s.session.PutFile(s.share, fullPath, offset, func(buffer []byte) (int, error) {
+	err = session.PutFile(s.share, fullPath, offset, func(buffer []byte) (int, error) {
 		byteCount, readErr := r.Read(buffer)
 		bytesWritten += int64(byteCount)
 		return byteCount, readErr
 	})
 	if err != nil {
-		return bytesWritten, fmt.Errorf("write SMB file %q: %w", fullPath, err)
+		return bytesWritten, fmt.Errorf("write SMB file %q: %w", fullPath, s.checkErr(session, err))
 	}
 
 	return bytesWritten, nil
 }
 
-func (s *smbStore) List(ctx context.Context) ([]string, error) {
-	var backups []string
+func (s *smbStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	fullPath := path.Join(s.basePath, key)
+	session, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	file, err := session.OpenFile(s.share, fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("open SMB file %q: %w", fullPath, smbNotExist(s.checkErr(session, err)))
+	}
+	return &smbReader{file: file}, nil
+}
+
+func (s *smbStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	fullPath := path.Join(s.basePath, key)
+	session, err := s.conn()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	file, err := session.OpenFile(s.share, fullPath)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat SMB file %q: %w", fullPath, smbNotExist(s.checkErr(session, err)))
+	}
+	defer file.CloseFile()
+
+	return ObjectInfo{
+		Key:     key,
+		Size:    int64(file.EndOfFile),
+		ModTime: filetimeToTime(file.LastWriteTime),
+	}, nil
+}
 
-	// List files in the base path (third argument is search pattern)
-	entries, err := s.session.ListDirectory(s.share, s.basePath, "*")
+func (s *smbStore) List(ctx context.Context) ([]ObjectInfo, error) {
+	session, err := s.conn()
 	if err != nil {
-		return nil, fmt.Errorf("list SMB directory %q: %w", s.basePath, err)
+		return nil, err
+	}
+	var backups []ObjectInfo
+	if err := s.walk(ctx, session, "", &backups); err != nil {
+		return nil, err
+	}
+	return backups, nil
+}
+
+// walk appends the backups and manifests below the directory prefix (relative to the
+// base path) to backups, descending into subdirectories so nested key
+// layouts are listed
+func (s *smbStore) walk(ctx context.Context, session *smb.Connection, prefix string, backups *[]ObjectInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dir := path.Join(s.basePath, prefix)
+	// Third argument is the search pattern
+	entries, err := session.ListDirectory(s.share, dir, "*")
+	if err != nil {
+		return fmt.Errorf("list SMB directory %q: %w", dir, s.checkErr(session, err))
 	}
 
-	// Filter for .unf files only
 	for _, entry := range entries {
-		if !entry.IsDir && strings.HasSuffix(entry.Name, ".unf") {
-			// Return filename without path prefix for consistency
-			backups = append(backups, entry.Name)
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		// Keys are relative to the base path and always use forward slashes
+		key := path.Join(prefix, entry.Name)
+		if entry.IsDir {
+			if err := s.walk(ctx, session, key, backups); err != nil {
+				return err
+			}
+			continue
+		}
+		if isBackupObject(entry.Name) {
+			*backups = append(*backups, ObjectInfo{
+				Key:     key,
+				Size:    int64(entry.Size),
+				ModTime: filetimeToTime(entry.LastWriteTime),
+			})
 		}
 	}
 
-	return backups, nil
+	return nil
+}
+
+func (s *smbStore) createExclusive(ctx context.Context, key string, data []byte) error {
+	fullPath := path.Join(s.basePath, key)
+	session, err := s.conn()
+	if err != nil {
+		return err
+	}
+	if dir := path.Dir(fullPath); dir != "." && dir != "/" {
+		if err := session.MkdirAll(s.share, dir); err != nil {
+			slog.Debug("mkdir warning (may be ignorable)", "dir", dir, "error", err)
+		}
+	}
+
+	// FILE_CREATE fails atomically on the server if the file already exists
+	opts := smb.NewCreateReqOpts()
+	opts.DesiredAccess = smb.FAccMaskFileWriteData | smb.FAccMaskFileWriteAttributes | smb.FAccMaskSynchronize
+	opts.CreateDisp = smb.FileCreate
+	file, err := session.OpenFileExt(s.share, fullPath, opts)
+	if err != nil {
+		if err == smb.StatusMap[smb.StatusObjectNameCollision] {
+			return fmt.Errorf("create SMB file %q: %w", fullPath, ErrPreconditionFailed)
+		}
+		return fmt.Errorf("create SMB file %q: %w", fullPath, s.checkErr(session, err))
+	}
+	defer file.CloseFile()
+
+	if _, err := file.WriteFile(data, 0); err != nil {
+		return fmt.Errorf("write SMB file %q: %w", fullPath, s.checkErr(session, err))
+	}
+	return nil
 }
 
 func (s *smbStore) Delete(ctx context.Context, key string) error {
 	fullPath := path.Join(s.basePath, key)
-	err := s.session.DeleteFile(s.share, fullPath)
+	session, err := s.conn()
 	if err != nil {
-		return fmt.Errorf("delete SMB file %q: %w", fullPath, err)
+		return err
+	}
+	if err := session.DeleteFile(s.share, fullPath); err != nil {
+		return fmt.Errorf("delete SMB file %q: %w", fullPath, smbNotExist(s.checkErr(session, err)))
 	}
 	return nil
 }
 
 func (s *smbStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.session != nil {
 		if err := s.session.TreeDisconnect(s.share); err != nil {
 			slog.Warn("SMB tree disconnect failed", "error", err)
@@ -93,6 +273,40 @@ func (s *smbStore) Close() error {
 	return nil
 }
 
+// smbReader adapts an open SMB file to io.ReadCloser
+type smbReader struct {
+	file   *smb.File
+	offset uint64
+}
+
+func (r *smbReader) Read(p []byte) (int, error) {
+	n, err := r.file.ReadFile(p, r.offset)
+	r.offset += uint64(n)
+	return n, err
+}
+
+func (r *smbReader) Close() error {
+	return r.file.CloseFile()
+}
+
+// smbNotExist maps the SMB "not found" statuses to ErrNotExist
+func smbNotExist(err error) error {
+	if err == smb.StatusMap[smb.StatusObjectNameNotFound] || err == smb.StatusMap[smb.StatusObjectPathNotFound] {
+		return fmt.Errorf("%w: %v", ErrNotExist, err)
+	}
+	return err
+}
+
+// filetimeToTime converts a Windows FILETIME (100ns intervals since
+// 1601-01-01) to a time.Time
+func filetimeToTime(ft uint64) time.Time {
+	const epochDelta = 116444736000000000 // 1601-01-01 to 1970-01-01 in 100ns
+	if ft < epochDelta {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ft-epochDelta)*100).UTC()
+}
+
 // smbConfig holds the parsed SMB connection configuration (unexported, internal use only)
 type smbConfig struct {
 	Host     string
@@ -179,19 +393,9 @@ func OpenSMBStore(smbURL string) (ObjectStore, error) {
 		},
 	}
 
-	session, err := smb.NewConnection(options)
+	session, err := dialSMB(options, cfg.Share)
 	if err != nil {
-		return nil, fmt.Errorf("connect to SMB server %s:%d: %w", cfg.Host, cfg.Port, err)
-	}
-
-	if !session.IsAuthenticated() {
-		session.Close()
-		return nil, fmt.Errorf("SMB authentication failed for user %s", cfg.Username)
-	}
-
-	if err := session.TreeConnect(cfg.Share); err != nil {
-		session.Close()
-		return nil, fmt.Errorf("connect to share %q: %w", cfg.Share, err)
+		return nil, err
 	}
 
 	slog.Debug("SMB connection established",
@@ -203,7 +407,31 @@ func OpenSMBStore(smbURL string) (ObjectStore, error) {
 
 	return &smbStore{
 		session:  session,
+		options:  options,
 		share:    cfg.Share,
 		basePath: cfg.BasePath,
 	}, nil
 }
+
+// dialSMB connects and authenticates to the SMB server and connects to share
+func dialSMB(options smb.Options, share string) (*smb.Connection, error) {
+	session, err := smb.NewConnection(options)
+	if err != nil {
+		return nil, fmt.Errorf("connect to SMB server %s:%d: %w", options.Host, options.Port, err)
+	}
+
+	if !session.IsAuthenticated() {
+		session.Close()
+		user := ""
+		if ntlm, ok := options.Initiator.(*spnego.NTLMInitiator); ok {
+			user = ntlm.User
+		}
+		return nil, backoff.Permanent(fmt.Errorf("SMB authentication failed for user %s", user))
+	}
+
+	if err := session.TreeConnect(share); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("connect to share %q: %w", share, err)
+	}
+	return session, nil
+}
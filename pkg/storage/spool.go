@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+)
+
+// Spool holds a complete local copy of a backup so that it can be uploaded
+// to several destinations, and retried, without downloading it again.
+type Spool struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+// NewSpool reads r to the end. Up to maxMemory bytes are kept in memory;
+// larger content is written to a temporary file in dir, or the default
+// temporary directory when dir is empty.
+//
+// The caller must Close the spool to remove the temporary file.
+func NewSpool(r io.Reader, dir string, maxMemory int64) (*Spool, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, maxMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("spool backup: %w", err)
+	}
+	if n <= maxMemory {
+		return &Spool{data: buf.Bytes(), size: n}, nil
+	}
+
+	file, err := os.CreateTemp(dir, ".unifi-backup-spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("create spool file: %w", err)
+	}
+	s := &Spool{file: file}
+	written, err := io.Copy(file, io.MultiReader(&buf, r))
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("spool backup to %s: %w", file.Name(), err)
+	}
+	s.size = written
+	return s, nil
+}
+
+// Size returns the number of spooled bytes.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// Reader returns a new reader over the whole spooled content.
+func (s *Spool) Reader() io.Reader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.data)
+}
+
+// Close releases the spooled content and removes the temporary file.
+func (s *Spool) Close() error {
+	s.data = nil
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	err := os.Remove(s.file.Name())
+	s.file = nil
+	return err
+}
+
+// UploadSpool uploads the spooled backup to every destination concurrently.
+// Each destination is retried from the local copy according to policy,
+// independently of the others.
+//
+// The returned results are in the same order as dests.
+func UploadSpool(ctx context.Context, key string, spool *Spool, dests []Destination, policy backoff.Policy) []PutResult {
+	results := make([]PutResult, len(dests))
+
+	var wg sync.WaitGroup
+	for i, dest := range dests {
+		results[i] = PutResult{Name: dest.Name, Required: dest.Required}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].Err = policy.Retry(ctx, func() error {
+				written, err := dest.Store.Put(ctx, key, spool.Reader())
+				results[i].Written = written
+				if err == nil && written != spool.Size() {
+					err = fmt.Errorf("size mismatch: spooled %d bytes, wrote %d", spool.Size(), written)
+				}
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
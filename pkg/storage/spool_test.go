@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+)
+
+// flakyStore fails the first failures calls to Put after reading part of
+// the data
+type flakyStore struct {
+	*memStore
+	failures int
+	puts     int
+}
+
+func (s *flakyStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	s.puts++
+	if s.puts <= s.failures {
+		n, _ := io.CopyN(io.Discard, r, 10)
+		return n, errors.New("simulated upload failure")
+	}
+	return s.memStore.Put(ctx, key, r)
+}
+
+func TestNewSpoolKeepsSmallBackupsInMemory(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 100)
+
+	spool, err := NewSpool(bytes.NewReader(data), t.TempDir(), 100)
+	if err != nil {
+		t.Fatalf("NewSpool() error = %v", err)
+	}
+	defer spool.Close()
+
+	if spool.file != nil {
+		t.Error("expected backup to be spooled in memory")
+	}
+	got, _ := io.ReadAll(spool.Reader())
+	if !bytes.Equal(got, data) || spool.Size() != 100 {
+		t.Errorf("spooled %d bytes, size %d", len(got), spool.Size())
+	}
+}
+
+func TestNewSpoolSpillsLargeBackupsToDisk(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	spool, err := NewSpool(bytes.NewReader(data), dir, 100)
+	if err != nil {
+		t.Fatalf("NewSpool() error = %v", err)
+	}
+	if spool.file == nil {
+		t.Fatal("expected backup to be spooled to disk")
+	}
+
+	// Every reader starts at the beginning
+	for range 2 {
+		got, _ := io.ReadAll(spool.Reader())
+		if !bytes.Equal(got, data) {
+			t.Fatalf("spooled %d bytes, want %d", len(got), len(data))
+		}
+	}
+
+	if err := spool.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("spool file not removed: %v", entries)
+	}
+}
+
+func TestUploadSpoolRetriesEachDestination(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1000)
+	spool, err := NewSpool(bytes.NewReader(data), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	flaky := &flakyStore{memStore: newMemStore(), failures: 1}
+	healthy := newMemStore()
+	broken := &flakyStore{memStore: newMemStore(), failures: 10}
+
+	results := UploadSpool(context.Background(), "backup.unf", spool, []Destination{
+		{Name: "flaky", Store: flaky, Required: true},
+		{Name: "healthy", Store: healthy, Required: true},
+		{Name: "broken", Store: broken},
+	}, backoff.Policy{MaxRetries: 1})
+
+	if results[0].Err != nil || !bytes.Equal(flaky.objects["backup.unf"], data) {
+		t.Errorf("flaky destination: err = %v, puts = %d", results[0].Err, flaky.puts)
+	}
+	if results[1].Err != nil || results[1].Written != int64(len(data)) {
+		t.Errorf("healthy destination: %+v", results[1])
+	}
+	if results[2].Err == nil || broken.puts != 2 {
+		t.Errorf("broken destination: err = %v, puts = %d", results[2].Err, broken.puts)
+	}
+}
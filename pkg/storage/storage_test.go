@@ -1,8 +1,13 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"testing"
 	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
 )
 
 func TestParseBackupFilename(t *testing.T) {
@@ -84,3 +89,13 @@ func TestGenerateBackupFilename(t *testing.T) {
 		t.Errorf("Generated timestamp is too old: %v", timestamp)
 	}
 }
+
+func TestErrNotExistIsNotRetried(t *testing.T) {
+	err := fmt.Errorf("stat object %q: %w", "backup.unf", ErrNotExist)
+	if !errors.Is(err, ErrNotExist) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("errors.Is(%v) does not match ErrNotExist and fs.ErrNotExist", err)
+	}
+	if backoff.IsRetryable(err) {
+		t.Error("IsRetryable(ErrNotExist) = true, want false")
+	}
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultSyncConcurrency is the number of objects copied in parallel when
+// SyncOptions.Concurrency is not set
+const defaultSyncConcurrency = 4
+
+// SyncOptions configures Sync.
+type SyncOptions struct {
+	// Concurrency limits the number of objects copied in parallel
+	Concurrency int
+	// Delete removes backups from the destination that do not exist in the source
+	Delete bool
+	// Verify reads each copied object back from the destination and compares
+	// its SHA-256 checksum with the source
+	Verify bool
+	// DryRun logs the planned actions without copying or deleting anything
+	DryRun bool
+	// Layout parses the backup time from source keys to copy the oldest
+	// backups first (nil for the default flat layout)
+	Layout *KeyLayout
+}
+
+// SyncResult summarizes the outcome of Sync.
+type SyncResult struct {
+	Copied  int
+	Skipped int
+	Deleted int
+	Failed  int
+	// BytesCopied is the total size of all copied objects
+	BytesCopied int64
+}
+
+// backupTime returns the backup time parsed from the key of obj, or of the
+// backup a manifest belongs to, falling back to its modification time for
+// keys that do not match the layout
+func backupTime(layout *KeyLayout, obj ObjectInfo) time.Time {
+	if data, err := layout.Parse(strings.TrimSuffix(obj.Key, ManifestSuffix)); err == nil {
+		return data.Time
+	}
+	return obj.ModTime.UTC()
+}
+
+// Sync copies backups from src that are missing in dst.
+//
+// A backup is considered present in dst when an object with the same key and
+// size exists, so an interrupted sync can simply be run again and resumes
+// with the objects that were not copied yet. Objects with a size mismatch
+// (e.g. a partial upload) are copied again.
+//
+// Individual copy failures are counted in the result and do not stop the
+// remaining copies. The returned error is only set when a store cannot be
+// listed or the context is cancelled.
+func Sync(ctx context.Context, src, dst ObjectStore, opts SyncOptions) (SyncResult, error) {
+	var result SyncResult
+
+	srcObjects, err := src.List(ctx)
+	if err != nil {
+		return result, fmt.Errorf("list source: %w", err)
+	}
+	dstObjects, err := dst.List(ctx)
+	if err != nil {
+		return result, fmt.Errorf("list destination: %w", err)
+	}
+
+	// Copy oldest first so an interrupted sync leaves a contiguous history
+	layout := opts.Layout
+	if layout == nil {
+		if layout, err = NewKeyLayout(DefaultKeyTemplate); err != nil {
+			return result, err
+		}
+	}
+	times := make(map[string]time.Time, len(srcObjects))
+	for _, obj := range srcObjects {
+		times[obj.Key] = backupTime(layout, obj)
+	}
+	sort.Slice(srcObjects, func(i, j int) bool {
+		ti, tj := times[srcObjects[i].Key], times[srcObjects[j].Key]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return srcObjects[i].Key < srcObjects[j].Key
+	})
+
+	existing := make(map[string]ObjectInfo, len(dstObjects))
+	for _, obj := range dstObjects {
+		existing[obj.Key] = obj
+	}
+
+	var toCopy []ObjectInfo
+	for _, obj := range srcObjects {
+		if dstObj, ok := existing[obj.Key]; ok && dstObj.Size == obj.Size {
+			result.Skipped++
+			continue
+		}
+		toCopy = append(toCopy, obj)
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultSyncConcurrency
+	}
+
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+
+	for _, obj := range toCopy {
+		if gctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			if opts.DryRun {
+				slog.Info("Would copy backup", "key", obj.Key, "size", FormatBytes(obj.Size))
+				mu.Lock()
+				result.Copied++
+				mu.Unlock()
+				return nil
+			}
+
+			err := copyObject(gctx, src, dst, obj, obj.Key, opts.Verify)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				slog.Warn("Failed to copy backup", "key", obj.Key, "error", err)
+				result.Failed++
+				return nil
+			}
+			slog.Info("Copied backup", "key", obj.Key, "size", FormatBytes(obj.Size))
+			result.Copied++
+			result.BytesCopied += obj.Size
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	if opts.Delete {
+		inSource := make(map[string]bool, len(srcObjects))
+		for _, obj := range srcObjects {
+			inSource[obj.Key] = true
+		}
+		for _, obj := range dstObjects {
+			if inSource[obj.Key] {
+				continue
+			}
+			if opts.DryRun {
+				slog.Info("Would delete backup from destination", "key", obj.Key)
+				result.Deleted++
+				continue
+			}
+			if err := dst.Delete(ctx, obj.Key); err != nil {
+				slog.Warn("Failed to delete backup from destination", "key", obj.Key, "error", err)
+				result.Failed++
+				continue
+			}
+			slog.Info("Deleted backup from destination", "key", obj.Key)
+			result.Deleted++
+		}
+	}
+
+	return result, nil
+}
+
+// copyObject streams a single object from src to dstKey in dst and verifies
+// its size, and optionally its SHA-256 checksum, after the upload.
+func copyObject(ctx context.Context, src, dst ObjectStore, obj ObjectInfo, dstKey string, verify bool) error {
+	reader, err := src.Get(ctx, obj.Key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	written, err := dst.Put(ctx, dstKey, NewSizedReader(io.TeeReader(reader, hash), obj.Size))
+	if err != nil {
+		return err
+	}
+	if written != obj.Size {
+		return fmt.Errorf("size mismatch: source has %d bytes, wrote %d", obj.Size, written)
+	}
+
+	if !verify {
+		return nil
+	}
+
+	dstSum, err := checksumObject(ctx, dst, dstKey)
+	if err != nil {
+		return fmt.Errorf("verify copy: %w", err)
+	}
+	if !bytes.Equal(dstSum, hash.Sum(nil)) {
+		// Remove the corrupt copy so the next sync copies it again
+		if err := dst.Delete(ctx, dstKey); err != nil {
+			slog.Warn("Failed to delete corrupt copy", "key", dstKey, "error", err)
+		}
+		return fmt.Errorf("checksum mismatch after copy")
+	}
+	return nil
+}
+
+// checksumObject returns the SHA-256 checksum of the stored object
+func checksumObject(ctx context.Context, store ObjectStore, key string) ([]byte, error) {
+	reader, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return nil, fmt.Errorf("read %q: %w", key, err)
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestSyncCopiesMissingBackups(t *testing.T) {
+	src, dst := newMemStore(), newMemStore()
+	src.objects["unifi-backup-2025-01-01T00-00-00Z.unf"] = []byte("first")
+	src.objects["unifi-backup-2025-01-02T00-00-00Z.unf"] = []byte("second")
+	src.objects["unifi-backup-2025-01-03T00-00-00Z.unf"] = []byte("third")
+	// Already synced
+	dst.objects["unifi-backup-2025-01-01T00-00-00Z.unf"] = []byte("first")
+	// Partial copy from an interrupted sync
+	dst.objects["unifi-backup-2025-01-02T00-00-00Z.unf"] = []byte("sec")
+
+	result, err := Sync(context.Background(), src, dst, SyncOptions{Concurrency: 2, Verify: true})
+	if err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+
+	if result.Copied != 2 || result.Skipped != 1 || result.Failed != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	for key, data := range src.objects {
+		if !bytes.Equal(dst.objects[key], data) {
+			t.Errorf("destination %q = %q, want %q", key, dst.objects[key], data)
+		}
+	}
+}
+
+func TestSyncDeletesExtraBackups(t *testing.T) {
+	src, dst := newMemStore(), newMemStore()
+	src.objects["unifi-backup-2025-01-02T00-00-00Z.unf"] = []byte("kept")
+	dst.objects["unifi-backup-2025-01-01T00-00-00Z.unf"] = []byte("pruned")
+	dst.objects["unifi-backup-2025-01-02T00-00-00Z.unf"] = []byte("kept")
+
+	result, err := Sync(context.Background(), src, dst, SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+
+	if result.Deleted != 1 || result.Skipped != 1 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if _, ok := dst.objects["unifi-backup-2025-01-01T00-00-00Z.unf"]; ok {
+		t.Error("expected extra backup to be deleted from destination")
+	}
+}
+
+func TestSyncDryRunChangesNothing(t *testing.T) {
+	src, dst := newMemStore(), newMemStore()
+	src.objects["unifi-backup-2025-01-02T00-00-00Z.unf"] = []byte("new")
+	dst.objects["unifi-backup-2025-01-01T00-00-00Z.unf"] = []byte("old")
+
+	result, err := Sync(context.Background(), src, dst, SyncOptions{Delete: true, DryRun: true})
+	if err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+
+	if result.Copied != 1 || result.Deleted != 1 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if len(dst.objects) != 1 {
+		t.Errorf("dry run modified destination: %v", dst.objects)
+	}
+}
+
+func TestSyncCopiesOldestFirst(t *testing.T) {
+	layout, err := NewKeyLayout("{{.Controller}}/{{.Site}}/unifi-{{.Timestamp}}.unf")
+	if err != nil {
+		t.Fatalf("NewKeyLayout() error = %v", err)
+	}
+
+	src, dst := newMemStore(), newMemStore()
+	// Key order is controller and site order, not time order
+	src.objects["alpha/default/unifi-2025-01-03T00-00-00Z.unf"] = []byte("third")
+	src.objects["beta/default/unifi-2025-01-01T00-00-00Z.unf"] = []byte("first")
+	src.objects["beta/default/unifi-2025-01-01T00-00-00Z.unf.json"] = []byte("{}")
+	src.objects["gamma/default/unifi-2025-01-02T00-00-00Z.unf"] = []byte("second")
+
+	if _, err := Sync(context.Background(), src, dst, SyncOptions{Concurrency: 1, Layout: layout}); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+
+	want := []string{
+		"beta/default/unifi-2025-01-01T00-00-00Z.unf",
+		"beta/default/unifi-2025-01-01T00-00-00Z.unf.json",
+		"gamma/default/unifi-2025-01-02T00-00-00Z.unf",
+		"alpha/default/unifi-2025-01-03T00-00-00Z.unf",
+	}
+	if !slices.Equal(dst.puts, want) {
+		t.Errorf("copy order = %v, want %v", dst.puts, want)
+	}
+}
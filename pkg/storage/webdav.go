@@ -0,0 +1,493 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+)
+
+// propfindBody requests the properties needed to describe backups
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+  </d:prop>
+</d:propfind>`
+
+type webdavStore struct {
+	client   *http.Client
+	baseURL  *url.URL
+	username string
+	password string
+
+	mu          sync.Mutex
+	collections map[string]bool
+}
+
+func (s *webdavStore) Put(ctx context.Context, key string, r io.Reader) (written int64, err error) {
+	fullPath := s.keyPath(key)
+	if err := s.ensureCollection(ctx, path.Dir(fullPath)); err != nil {
+		return 0, err
+	}
+
+	// Many servers reject chunked uploads, so send a Content-Length when the
+	// size is known, e.g. from NewSizedReader, and stream chunked otherwise
+	counter := &countingReader{r: r}
+	var body io.Reader = counter
+	if size, ok := readerSize(r); ok {
+		body = &sizedReader{r: counter, size: size}
+	}
+	resp, err := s.do(ctx, http.MethodPut, fullPath, body, nil)
+	if err != nil {
+		return counter.n, fmt.Errorf("upload WebDAV file %q: %w", key, err)
+	}
+	defer drainClose(resp)
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return counter.n, fmt.Errorf("upload WebDAV file %q: %w", key, statusError(resp))
+	}
+
+	return counter.n, nil
+}
+
+// createExclusive uploads data with If-None-Match: *, which servers such as
+// Apache mod_dav and Nextcloud reject with 412 when the file already exists
+func (s *webdavStore) createExclusive(ctx context.Context, key string, data []byte) error {
+	fullPath := s.keyPath(key)
+	if err := s.ensureCollection(ctx, path.Dir(fullPath)); err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, fullPath, bytes.NewReader(data), map[string]string{
+		"If-None-Match": "*",
+	})
+	if err != nil {
+		return fmt.Errorf("create WebDAV file %q: %w", key, err)
+	}
+	defer drainClose(resp)
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return fmt.Errorf("create WebDAV file %q: %w", key, ErrPreconditionFailed)
+	default:
+		return fmt.Errorf("create WebDAV file %q: %w", key, statusError(resp))
+	}
+}
+
+// ensureCollection creates the collection at the absolute server path dir
+// and any missing parents. Collections known to exist are cached.
+func (s *webdavStore) ensureCollection(ctx context.Context, dir string) error {
+	if dir == "/" || dir == "." || dir == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	exists := s.collections[dir]
+	s.mu.Unlock()
+	if exists {
+		return nil
+	}
+
+	_, err := s.propfind(ctx, dir, "0")
+	if errors.Is(err, ErrNotExist) {
+		if err := s.ensureCollection(ctx, path.Dir(dir)); err != nil {
+			return err
+		}
+
+		resp, err := s.do(ctx, "MKCOL", dir+"/", nil, nil)
+		if err != nil {
+			return fmt.Errorf("create WebDAV collection %q: %w", dir, err)
+		}
+		// 405 Method Not Allowed means the collection was created concurrently
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			err := fmt.Errorf("create WebDAV collection %q: %w", dir, statusError(resp))
+			drainClose(resp)
+			return err
+		}
+		drainClose(resp)
+	} else if err != nil {
+		return fmt.Errorf("check WebDAV collection %q: %w", dir, err)
+	}
+
+	s.mu.Lock()
+	s.collections[dir] = true
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *webdavStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.keyPath(key), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("download WebDAV file %q: %w", key, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		drainClose(resp)
+		return nil, fmt.Errorf("download WebDAV file %q: %w", key, ErrNotExist)
+	default:
+		defer drainClose(resp)
+		return nil, fmt.Errorf("download WebDAV file %q: %w", key, statusError(resp))
+	}
+}
+
+func (s *webdavStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	entries, err := s.propfind(ctx, s.keyPath(key), "0")
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat WebDAV file %q: %w", key, err)
+	}
+	for _, entry := range entries {
+		if !entry.isDir {
+			entry.info.Key = key
+			return entry.info, nil
+		}
+	}
+	return ObjectInfo{}, fmt.Errorf("stat WebDAV file %q: %w", key, ErrNotExist)
+}
+
+func (s *webdavStore) List(ctx context.Context) ([]ObjectInfo, error) {
+	var backups []ObjectInfo
+	if err := s.walk(ctx, "", &backups); err != nil {
+		if errors.Is(err, ErrNotExist) {
+			// A missing base collection simply means no backups have been written yet
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list WebDAV collection %q: %w", s.baseURL.Path, err)
+	}
+	return backups, nil
+}
+
+// walk appends the backups and manifests below the collection prefix (relative to the
+// base URL) to backups. Depth-1 PROPFINDs are used per collection since many
+// servers refuse Depth: infinity.
+func (s *webdavStore) walk(ctx context.Context, prefix string, backups *[]ObjectInfo) error {
+	entries, err := s.propfind(ctx, strings.TrimSuffix(s.keyPath(prefix), "/")+"/", "1")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// The collection itself is part of its own listing
+		if entry.info.Key == prefix {
+			continue
+		}
+		if entry.isDir {
+			if err := s.walk(ctx, entry.info.Key, backups); err != nil {
+				return err
+			}
+			continue
+		}
+		if isBackupObject(entry.info.Key) {
+			*backups = append(*backups, entry.info)
+		}
+	}
+	return nil
+}
+
+func (s *webdavStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.keyPath(key), nil, nil)
+	if err != nil {
+		return fmt.Errorf("delete WebDAV file %q: %w", key, err)
+	}
+	defer drainClose(resp)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("delete WebDAV file %q: %w", key, ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delete WebDAV file %q: %w", key, statusError(resp))
+	}
+	return nil
+}
+
+func (s *webdavStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// webdavEntry is a single resource from a PROPFIND response
+type webdavEntry struct {
+	info  ObjectInfo
+	isDir bool
+}
+
+// propfindResponse is the subset of a DAV:multistatus response used by the store
+type propfindResponse struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// propfind lists the resource at the absolute server path p with the given
+// Depth header. Keys in the returned entries are relative to the base URL.
+func (s *webdavStore) propfind(ctx context.Context, p, depth string) ([]webdavEntry, error) {
+	resp, err := s.do(ctx, "PROPFIND", p, strings.NewReader(propfindBody), map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer drainClose(resp)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND: %w", statusError(resp))
+	}
+
+	var ms propfindResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("decode PROPFIND response: %w", err)
+	}
+
+	basePath := strings.TrimSuffix(s.baseURL.Path, "/") + "/"
+
+	var entries []webdavEntry
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			slog.Debug("Skipping WebDAV entry with invalid href", "href", r.Href, "error", err)
+			continue
+		}
+
+		entry := webdavEntry{info: ObjectInfo{
+			Key: strings.TrimSuffix(strings.TrimPrefix(href.Path, basePath), "/"),
+		}}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			entry.isDir = entry.isDir || ps.Prop.ResourceType.Collection != nil
+			if ps.Prop.ContentLength != "" {
+				entry.info.Size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			}
+			if ps.Prop.LastModified != "" {
+				entry.info.ModTime, _ = http.ParseTime(ps.Prop.LastModified)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// keyPath returns the absolute server path of key
+func (s *webdavStore) keyPath(key string) string {
+	return s.baseURL.Path + "/" + strings.TrimPrefix(key, "/")
+}
+
+// do sends a request for the absolute server path p
+func (s *webdavStore) do(ctx context.Context, method, p string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	target := *s.baseURL
+	target.Path = p
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if sized, ok := body.(*sizedReader); ok {
+		req.ContentLength = sized.size
+		if sized.size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	if s.username != "" || s.password != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	return s.client.Do(req)
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// drainClose discards the rest of the body so the connection can be reused
+func drainClose(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+// httpStatusError is an unexpected HTTP response from the WebDAV server
+type httpStatusError struct {
+	status     string
+	statusCode int
+	msg        string
+	retryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	if e.msg != "" {
+		return fmt.Sprintf("unexpected status %s: %s", e.status, e.msg)
+	}
+	return fmt.Sprintf("unexpected status %s", e.status)
+}
+
+// Retryable reports whether the request may succeed when repeated. Client
+// errors other than timeouts, locks and rate limits are permanent.
+func (e *httpStatusError) Retryable() bool {
+	switch e.statusCode {
+	case http.StatusRequestTimeout, http.StatusLocked, http.StatusTooManyRequests:
+		return true
+	}
+	return e.statusCode < 400 || e.statusCode >= 500
+}
+
+// RetryAfter returns the delay requested by a Retry-After header.
+func (e *httpStatusError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// statusError returns an error describing an unexpected HTTP response
+func statusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &httpStatusError{
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+		msg:        strings.TrimSpace(string(body)),
+		retryAfter: backoff.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// webdavConfig holds the parsed WebDAV connection configuration (unexported, internal use only)
+type webdavConfig struct {
+	BaseURL  *url.URL
+	Username string
+	Password string
+	CAFile   string
+}
+
+// parseWebDAVURL parses URLs in the format:
+// webdav[s]://[username[:password]@]host[:port]/path[?ca=/path/to/ca.pem]
+//
+// webdav:// uses plain HTTP and webdavs:// uses HTTPS.
+func parseWebDAVURL(webdavURL string) (*webdavConfig, error) {
+	u, err := url.Parse(webdavURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse URL: %w", err)
+	}
+
+	cfg := &webdavConfig{}
+	switch u.Scheme {
+	case "webdav":
+		u.Scheme = "http"
+	case "webdavs":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("expected webdav:// or webdavs:// scheme, got %s://", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("host required")
+	}
+
+	if u.User != nil {
+		cfg.Username = u.User.Username()
+		cfg.Password, _ = u.User.Password()
+		u.User = nil
+	}
+
+	query := u.Query()
+	cfg.CAFile = query.Get("ca")
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+
+	cfg.BaseURL = u
+	return cfg, nil
+}
+
+// OpenWebDAVStore opens a WebDAV storage backend from the given URL
+func OpenWebDAVStore(ctx context.Context, webdavURL string) (ObjectStore, error) {
+	cfg, err := parseWebDAVURL(webdavURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse WebDAV URL: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	store := &webdavStore{
+		client:   &http.Client{Transport: transport},
+		baseURL:  cfg.BaseURL,
+		username: cfg.Username,
+		password: cfg.Password,
+
+		collections: make(map[string]bool),
+	}
+
+	// Check the server is reachable and the credentials are accepted
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if _, err := store.propfind(ctx, cfg.BaseURL.Path+"/", "0"); err != nil && !errors.Is(err, ErrNotExist) {
+		store.Close()
+		return nil, fmt.Errorf("connect to WebDAV server %s: %w", cfg.BaseURL.Host, err)
+	}
+
+	slog.Debug("WebDAV connection established",
+		"url", cfg.BaseURL.String(),
+	)
+
+	return store, nil
+}
@@ -0,0 +1,209 @@
+package unifi
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// UniFi encrypts .unf backups with AES-128-CBC using these fixed parameters,
+// so the encryption only obscures the archive
+var (
+	backupKey = []byte("bcyangkmluohmars")
+	backupIV  = []byte("ubntenterpriseap")
+)
+
+// maxBSONDocumentSize is the largest document MongoDB allows
+const maxBSONDocumentSize = 16 << 20
+
+// RequiredCollections are the collections a usable backup must contain with
+// at least one document each.
+var RequiredCollections = []string{"site", "networkconf", "wlanconf", "device"}
+
+// BackupContents summarizes a decoded .unf backup.
+type BackupContents struct {
+	// Version is the UniFi Network version that created the backup
+	Version string
+	// Format is the backup format identifier
+	Format string
+	// Collections maps each collection in the database dump to its number
+	// of documents
+	Collections map[string]int
+}
+
+// InspectBackup decrypts and unpacks a .unf backup read from r and decodes
+// its database dump.
+//
+// The decrypted archive is spooled to a temporary file because zip archives
+// are read from the end.
+func InspectBackup(r io.Reader) (*BackupContents, error) {
+	tmp, err := os.CreateTemp("", "unifi-backup-*.zip")
+	if err != nil {
+		return nil, fmt.Errorf("create temporary file: %w", err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	size, err := decryptBackup(tmp, r)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, fmt.Errorf("open backup archive: %w", err)
+	}
+
+	contents := &BackupContents{Collections: make(map[string]int)}
+	foundDB := false
+	for _, f := range archive.File {
+		switch f.Name {
+		case "version":
+			if contents.Version, err = readArchiveString(f); err != nil {
+				return nil, err
+			}
+		case "format":
+			if contents.Format, err = readArchiveString(f); err != nil {
+				return nil, err
+			}
+		case "db.gz":
+			foundDB = true
+			if err := readDatabaseDump(f, contents.Collections); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !foundDB {
+		return nil, errors.New("backup archive has no db.gz")
+	}
+	return contents, nil
+}
+
+// Check verifies that the backup contains every required collection and,
+// when controllerVersion is set, that it was created by that version.
+func (c *BackupContents) Check(controllerVersion string) error {
+	var problems []string
+	for _, name := range RequiredCollections {
+		if c.Collections[name] == 0 {
+			problems = append(problems, fmt.Sprintf("collection %q is missing or empty", name))
+		}
+	}
+	if controllerVersion != "" && c.Version != controllerVersion {
+		problems = append(problems, fmt.Sprintf("backup version %q does not match controller version %q", c.Version, controllerVersion))
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// decryptBackup writes the decrypted backup from r to w and returns its size
+func decryptBackup(w io.Writer, r io.Reader) (int64, error) {
+	block, err := aes.NewCipher(backupKey)
+	if err != nil {
+		return 0, err
+	}
+	mode := cipher.NewCBCDecrypter(block, backupIV)
+
+	buf := make([]byte, 64*1024)
+	var total int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n%aes.BlockSize != 0 {
+			return total, fmt.Errorf("decrypt backup: size is not a multiple of %d bytes", aes.BlockSize)
+		}
+		if n > 0 {
+			mode.CryptBlocks(buf[:n], buf[:n])
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return total, fmt.Errorf("write decrypted backup: %w", werr)
+			}
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, fmt.Errorf("read backup: %w", err)
+		}
+	}
+}
+
+// readArchiveString returns the trimmed contents of a small archive file
+func readArchiveString(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", f.Name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readDatabaseDump counts the documents per collection in a gzipped stream
+// of BSON documents. The dump switches collections with documents of the
+// form {"__cmd": "select", "collection": "<name>"}.
+func readDatabaseDump(f *zip.File, collections map[string]int) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("open %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return fmt.Errorf("decompress %s: %w", f.Name, err)
+	}
+	defer gz.Close()
+
+	r := bufio.NewReader(gz)
+	collection := ""
+	for n := 0; ; n++ {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read document %d of %s: %w", n, f.Name, err)
+		}
+
+		size := binary.LittleEndian.Uint32(length[:])
+		if size < 5 || size > maxBSONDocumentSize {
+			return fmt.Errorf("document %d of %s has invalid size %d", n, f.Name, size)
+		}
+		doc := make(bson.Raw, size)
+		copy(doc, length[:])
+		if _, err := io.ReadFull(r, doc[4:]); err != nil {
+			return fmt.Errorf("read document %d of %s: %w", n, f.Name, err)
+		}
+		if err := doc.Validate(); err != nil {
+			return fmt.Errorf("decode document %d of %s: %w", n, f.Name, err)
+		}
+
+		if cmd, ok := doc.Lookup("__cmd").StringValueOK(); ok && cmd == "select" {
+			collection, _ = doc.Lookup("collection").StringValueOK()
+			if _, seen := collections[collection]; !seen {
+				collections[collection] = 0
+			}
+			continue
+		}
+		if collection == "" {
+			return fmt.Errorf("document %d of %s precedes the first collection", n, f.Name)
+		}
+		collections[collection]++
+	}
+}
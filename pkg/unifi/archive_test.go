@@ -0,0 +1,123 @@
+package unifi
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// buildBackup returns an encrypted .unf backup with the given version and
+// documents per collection
+func buildBackup(t *testing.T, version string, collections map[string]int) []byte {
+	t.Helper()
+
+	var dump bytes.Buffer
+	gz := gzip.NewWriter(&dump)
+	for name, count := range collections {
+		docs := []bson.D{{{Key: "__cmd", Value: "select"}, {Key: "collection", Value: name}}}
+		for i := range count {
+			docs = append(docs, bson.D{{Key: "name", Value: name}, {Key: "n", Value: i}})
+		}
+		for _, doc := range docs {
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = gz.Write(data)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for name, data := range map[string][]byte{"version": []byte(version + "\n"), "format": []byte("bson"), "db.gz": dump.Bytes()} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Zero padding to the block size, as written by the controller
+	plain := archive.Bytes()
+	if rem := len(plain) % aes.BlockSize; rem != 0 {
+		plain = append(plain, make([]byte, aes.BlockSize-rem)...)
+	}
+	block, err := aes.NewCipher(backupKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, backupIV).CryptBlocks(encrypted, plain)
+	return encrypted
+}
+
+func TestInspectBackupDecodesCollections(t *testing.T) {
+	t.Parallel()
+
+	data := buildBackup(t, "9.0.114", map[string]int{"site": 1, "networkconf": 3, "wlanconf": 2, "device": 5, "event": 0})
+
+	contents, err := InspectBackup(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("InspectBackup() error = %v", err)
+	}
+	if contents.Version != "9.0.114" || contents.Format != "bson" {
+		t.Errorf("Version = %q, Format = %q", contents.Version, contents.Format)
+	}
+	if contents.Collections["device"] != 5 || contents.Collections["networkconf"] != 3 {
+		t.Errorf("Collections = %v", contents.Collections)
+	}
+	if n, ok := contents.Collections["event"]; !ok || n != 0 {
+		t.Errorf("expected empty event collection, got %v", contents.Collections)
+	}
+	if err := contents.Check("9.0.114"); err != nil {
+		t.Errorf("Check() error = %v", err)
+	}
+}
+
+func TestBackupContentsCheck(t *testing.T) {
+	t.Parallel()
+
+	contents := &BackupContents{
+		Version:     "9.0.114",
+		Collections: map[string]int{"site": 1, "networkconf": 1, "wlanconf": 0},
+	}
+	err := contents.Check("9.1.0")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{`"wlanconf"`, `"device"`, "does not match"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestInspectBackupRejectsCorruptData(t *testing.T) {
+	t.Parallel()
+
+	data := buildBackup(t, "9.0.114", map[string]int{"site": 1})
+	// Corrupt the middle third; a single byte can land in zip header fields
+	// that are never checked
+	for i := len(data) / 3; i < 2*len(data)/3; i++ {
+		data[i] ^= 0xff
+	}
+
+	if _, err := InspectBackup(bytes.NewReader(data)); err == nil {
+		t.Error("expected error for corrupt backup")
+	}
+	if _, err := InspectBackup(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Error("expected error for truncated backup")
+	}
+}
@@ -2,7 +2,6 @@ package unifi
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,8 +10,10 @@ import (
 	"net/http/cookiejar"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
 	"github.com/ConnorsApps/unifi-backup/pkg/storage"
 )
 
@@ -43,7 +44,26 @@ type Client struct {
 	httpClient *http.Client
 	baseURL    string
 	site       string
-	csrfToken  string
+
+	// mu guards csrfToken, which the controller may refresh on any response,
+	// and the credentials used to log in again when the session expires
+	mu        sync.Mutex
+	csrfToken string
+	username  string
+	password  string
+	// generation counts logins, so that concurrent requests that find the
+	// session expired log in only once
+	generation int
+	// loginMu serializes logins after an expired session
+	loginMu sync.Mutex
+
+	// sessionMu guards sessionCache, the key and content of the session
+	// file last saved or restored
+	sessionMu    sync.Mutex
+	sessionCache *sessionCache
+
+	// download is the backoff policy for resuming interrupted downloads
+	download backoff.Policy
 }
 
 // ClientOptions configures the UniFi API client behavior.
@@ -51,10 +71,31 @@ type ClientOptions struct {
 	Site string
 	// InsecureSkipVerify controls TLS certificate verification
 	InsecureSkipVerify bool
+	// CAFile is a PEM bundle of certificates trusted in addition to the
+	// system roots
+	CAFile string
+	// PinnedSHA256 lists SHA-256 fingerprints of the controller's
+	// certificate or public key (SPKI). When set, the certificate must
+	// match one of them, and without CAFile it need not chain to a root.
+	PinnedSHA256 []string
+	// ClientCertFile and ClientKeyFile are a PEM certificate and key
+	// presented to controllers behind a reverse proxy that requires mutual
+	// TLS. ClientKeyFile defaults to ClientCertFile.
+	ClientCertFile string
+	ClientKeyFile  string
+	// Proxy selects the proxy for controller connections, see ParseProxy.
+	// If empty, the HTTPS_PROXY and NO_PROXY environment variables are used.
+	Proxy string
 	// Timeout sets the HTTP client timeout for all operations. If zero, a
 	// default timeout of 10 minutes is used. For large backups or slow
 	// controllers, you may need to increase this value.
 	Timeout time.Duration
+	// DownloadRetries is the number of times an interrupted backup download
+	// is resumed
+	DownloadRetries int
+	// Backoff sets the delays between download resume attempts. If nil,
+	// backoff.DefaultPolicy is used.
+	Backoff *backoff.Policy
 }
 
 // NewClient creates a new UniFi API client with the specified base URL and options.
@@ -75,21 +116,60 @@ func NewClient(baseURL string, opts ClientOptions) (*Client, error) {
 		timeout = opts.Timeout
 	}
 
+	transport, err := newTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	httpClient := &http.Client{
-		Jar: jar,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify},
-		},
-		Timeout: timeout,
+		Jar:       jar,
+		Transport: transport,
+		Timeout:   timeout,
+	}
+
+	download := backoff.DefaultPolicy(opts.DownloadRetries)
+	if opts.Backoff != nil {
+		download = opts.Backoff.WithMaxRetries(opts.DownloadRetries)
 	}
 
 	return &Client{
 		httpClient: httpClient,
 		baseURL:    strings.TrimSuffix(baseURL, "/"),
 		site:       opts.Site,
+
+		download: download,
 	}, nil
 }
 
+// csrf returns the current CSRF token
+func (c *Client) csrf() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.csrfToken
+}
+
+func (c *Client) setCSRF(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.csrfToken = token
+}
+
+// send sends req with the current CSRF token and keeps the refreshed token
+// that UniFi OS returns in the x-updated-csrf-token header of any response
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if token := c.csrf(); token != "" {
+		req.Header.Set("X-Csrf-Token", token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if token := strings.TrimSpace(resp.Header.Get("x-updated-csrf-token")); token != "" {
+		c.setCSRF(token)
+	}
+	return resp, nil
+}
+
 // Login authenticates with the UniFi controller using the provided credentials.
 func (c *Client) Login(ctx context.Context, username, password string) error {
 	slog.Info("Logging in to UniFi controller", "username", username)
@@ -111,7 +191,7 @@ func (c *Client) Login(ctx context.Context, username, password string) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	loginResp, err := c.httpClient.Do(req)
+	loginResp, err := c.send(req)
 	if err != nil {
 		return fmt.Errorf("login request failed: %w", err)
 	}
@@ -119,7 +199,7 @@ func (c *Client) Login(ctx context.Context, username, password string) error {
 
 	if loginResp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(loginResp.Body)
-		return fmt.Errorf("login failed with status %s: %s", loginResp.Status, string(body))
+		return newStatusError("login", loginResp, body)
 	}
 	_, _ = io.Copy(io.Discard, loginResp.Body)
 
@@ -128,14 +208,50 @@ func (c *Client) Login(ctx context.Context, username, password string) error {
 		csrfToken = strings.TrimSpace(loginResp.Header.Get("x-csrf-token"))
 	}
 	if csrfToken == "" {
-		return fmt.Errorf("login succeeded but response did not include CSRF token header")
+		return backoff.Permanent(fmt.Errorf("login succeeded but response did not include CSRF token header"))
 	}
-	c.csrfToken = csrfToken
+	c.setCSRF(csrfToken)
+	c.setCredentials(username, password)
 
 	slog.Info("Successfully logged in")
 	return nil
 }
 
+// Logout ends the controller session so that it does not stay valid until it
+// expires. It does nothing when the client is not logged in, and treats a
+// session the controller already dropped as logged out.
+func (c *Client) Logout(ctx context.Context) error {
+	if c.csrf() == "" {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/auth/logout", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create logout request: %w", err)
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return fmt.Errorf("logout request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode != http.StatusUnauthorized {
+		return newStatusError("logout", resp, body)
+	}
+
+	c.setCSRF("")
+	c.setCredentials("", "")
+	slog.Info("Logged out of UniFi controller")
+	return nil
+}
+
+// Close releases the idle connections of the client. The client can still
+// be used afterwards; new requests open new connections.
+func (c *Client) Close() {
+	c.httpClient.CloseIdleConnections()
+}
+
 // CreateBackup triggers a backup on the UniFi controller and returns the download URL.
 //
 // The includeDays parameter controls how much historical data to include:
@@ -164,19 +280,18 @@ func (c *Client) CreateBackup(ctx context.Context, username string, includeDays
 		return "", fmt.Errorf("failed to create backup request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	if c.csrfToken == "" {
+	if c.csrf() == "" {
 		return "", fmt.Errorf("missing CSRF token; call Login before creating backup")
 	}
-	req.Header.Set("X-Csrf-Token", c.csrfToken)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return "", fmt.Errorf("backup request failed: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("backup request failed with status %s: %s", resp.Status, string(body))
+		return "", newStatusError("backup request", resp, body)
 	}
 
 	var backupResult backupResp
@@ -188,8 +303,7 @@ func (c *Client) CreateBackup(ctx context.Context, username string, includeDays
 		if backupResult.Meta.Msg == "api.err.NoPermission" {
 			slog.Info(fmt.Sprintf("Make sure the user '%s' is an Administrator rather than just a Site Administrator", username))
 		}
-		return "", fmt.Errorf("backup failed: response_code=%s, message=%s, data_length=%d",
-			backupResult.Meta.Rc, backupResult.Meta.Msg, len(backupResult.Data))
+		return "", &APIError{Op: "backup", StatusCode: resp.StatusCode, Status: resp.Status, Rc: backupResult.Meta.Rc, Msg: backupResult.Meta.Msg}
 	}
 
 	backupURL := c.normalizeBackupURL(backupResult.Data[0].URL)
@@ -206,6 +320,9 @@ func (c *Client) CreateBackup(ctx context.Context, username string, includeDays
 type DownloadResponse struct {
 	Body          io.ReadCloser
 	ContentLength int64
+	// AcceptRanges reports whether the controller supports Range requests,
+	// which lets an interrupted download continue where it stopped
+	AcceptRanges bool
 }
 
 // DownloadBackup downloads the backup file from the given URL.
@@ -213,33 +330,149 @@ type DownloadResponse struct {
 // The backupURL should be obtained from a prior call to CreateBackup. The returned
 // DownloadResponse contains an io.ReadCloser with the backup file contents and the
 // expected content length in bytes.
+//
+// When the connection breaks while reading Body, the download is resumed up
+// to ClientOptions.DownloadRetries times: with a Range request when the
+// controller advertises Accept-Ranges, and otherwise by downloading the file
+// again and skipping the bytes that were already read. Body returns an error
+// if the final length does not match ContentLength.
 func (c *Client) DownloadBackup(ctx context.Context, backupURL string) (*DownloadResponse, error) {
 	slog.Info("Downloading backup file")
 	backupURL = c.normalizeBackupURL(backupURL)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backupURL, nil)
+	resp, err := c.openDownload(ctx, backupURL, 0)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create download request: %w", err)
+		return nil, err
+	}
+
+	contentLength := resp.ContentLength
+	slog.Info("Backup download started", "size", storage.FormatBytes(contentLength), "accept_ranges", resp.AcceptRanges)
+
+	resp.Body = &resumingBody{
+		ctx:        ctx,
+		client:     c,
+		url:        backupURL,
+		body:       resp.Body,
+		total:      contentLength,
+		ranges:     resp.AcceptRanges,
+		maxResumes: c.download.MaxRetries,
 	}
+	return resp, nil
+}
 
-	downloadResp, err := c.httpClient.Do(req)
+type sysinfoResp struct {
+	Meta struct {
+		Rc  string `json:"rc"`
+		Msg string `json:"msg,omitempty"`
+	} `json:"meta"`
+	Data []struct {
+		Version  string `json:"version"`
+		Hostname string `json:"hostname"`
+		Name     string `json:"name"`
+		Uptime   int64  `json:"uptime"`
+	} `json:"data"`
+}
+
+// consoleSystemResp is the response of the UniFi OS /api/system endpoint
+type consoleSystemResp struct {
+	Name     string `json:"name"`
+	Hardware struct {
+		ShortName string `json:"shortname"`
+		Name      string `json:"name"`
+	} `json:"hardware"`
+}
+
+// SystemInfo describes the controller hosting the UniFi Network application.
+type SystemInfo struct {
+	// Version is the UniFi Network application version
+	Version string
+	// Hostname is the console hostname
+	Hostname string
+	// Model is the console hardware model, e.g. UDMPRO. It is empty for
+	// controllers that do not run on UniFi OS.
+	Model string
+	// Uptime is how long the Network application has been running
+	Uptime time.Duration
+}
+
+// SystemInfo returns the Network application version, console hostname and
+// uptime from the stat/sysinfo endpoint of the configured site, and the
+// hardware model from the UniFi OS /api/system endpoint when available.
+func (c *Client) SystemInfo(ctx context.Context) (*SystemInfo, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		fmt.Sprintf("%s%s/api/s/%s/stat/sysinfo", c.baseURL, networkProxyPrefix, c.site),
+		nil,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download backup: %w", err)
+		return nil, fmt.Errorf("failed to create sysinfo request: %w", err)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sysinfo request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, newStatusError("sysinfo request", resp, body)
 	}
 
-	if downloadResp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(downloadResp.Body)
-		downloadResp.Body.Close()
-		return nil, fmt.Errorf("download failed with status %s: %s", downloadResp.Status, string(body))
+	var result sysinfoResp
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode sysinfo response: %w", err)
+	}
+	if result.Meta.Rc != "ok" || len(result.Data) == 0 {
+		return nil, &APIError{Op: "sysinfo", StatusCode: resp.StatusCode, Status: resp.Status, Rc: result.Meta.Rc, Msg: result.Meta.Msg}
 	}
 
-	contentLength := downloadResp.ContentLength
-	slog.Info("Backup download started", "size", storage.FormatBytes(contentLength))
+	info := &SystemInfo{
+		Version:  result.Data[0].Version,
+		Hostname: result.Data[0].Hostname,
+		Uptime:   time.Duration(result.Data[0].Uptime) * time.Second,
+	}
+	if info.Hostname == "" {
+		info.Hostname = result.Data[0].Name
+	}
 
-	return &DownloadResponse{
-		Body:          downloadResp.Body,
-		ContentLength: contentLength,
-	}, nil
+	// The model is only informational, so a controller without UniFi OS
+	// still reports the rest
+	console, err := c.consoleSystem(ctx)
+	if err != nil {
+		slog.Debug("Failed to read UniFi OS system info", "error", err)
+		return info, nil
+	}
+	info.Model = console.Hardware.ShortName
+	if info.Model == "" {
+		info.Model = console.Hardware.Name
+	}
+	if info.Hostname == "" {
+		info.Hostname = console.Name
+	}
+	return info, nil
+}
+
+// consoleSystem returns the UniFi OS system description from /api/system
+func (c *Client) consoleSystem(ctx context.Context) (*consoleSystemResp, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/system", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create system request: %w", err)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("system request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError("system request", resp, body)
+	}
+
+	var system consoleSystemResp
+	if err := json.Unmarshal(body, &system); err != nil {
+		return nil, fmt.Errorf("failed to decode system response: %w", err)
+	}
+	return &system, nil
 }
 
 func (c *Client) normalizeBackupURL(rawURL string) string {
@@ -280,3 +513,23 @@ func mustHost(rawBaseURL string) string {
 	}
 	return parsed.Host
 }
+
+// Ping checks that the controller answers HTTP requests without logging in.
+// Any response below 500 counts as reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create ping request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("ping failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return newStatusError("ping", resp, body)
+	}
+	return nil
+}
@@ -3,11 +3,16 @@ package unifi
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
 )
 
 func TestLoginUsesUniFiOSAuthEndpointAndStoresCSRF(t *testing.T) {
@@ -134,3 +139,204 @@ func TestDownloadBackupNormalizesRelativeURLToProxyPath(t *testing.T) {
 		t.Fatalf("unexpected body: %s", string(body))
 	}
 }
+
+func TestSystemInfoReadsVersionAndHostname(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		system    string
+		wantModel string
+	}{
+		"unifi os":      {system: `{"name":"Office","hardware":{"shortname":"UDMPRO","name":"UniFi Dream Machine Pro"}}`, wantModel: "UDMPRO"},
+		"without model": {},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet {
+					t.Errorf("unexpected method: %s", r.Method)
+				}
+				switch r.URL.Path {
+				case "/proxy/network/api/s/default/stat/sysinfo":
+					_, _ = w.Write([]byte(`{"meta":{"rc":"ok"},"data":[{"version":"9.0.114","hostname":"UDM-Pro","timezone":"UTC","uptime":93784}]}`))
+				case "/api/system":
+					if tt.system == "" {
+						http.NotFound(w, r)
+						return
+					}
+					_, _ = w.Write([]byte(tt.system))
+				default:
+					t.Errorf("unexpected path: %s", r.URL.Path)
+				}
+			}))
+			defer server.Close()
+
+			client, err := NewClient(server.URL, ClientOptions{Site: "default"})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+
+			info, err := client.SystemInfo(context.Background())
+			if err != nil {
+				t.Fatalf("SystemInfo() error = %v", err)
+			}
+			want := SystemInfo{Version: "9.0.114", Hostname: "UDM-Pro", Model: tt.wantModel, Uptime: 26*time.Hour + 3*time.Minute + 4*time.Second}
+			if *info != want {
+				t.Errorf("SystemInfo() = %+v, want %+v", *info, want)
+			}
+		})
+	}
+}
+
+func TestCreateBackupReportsPermanentAPIError(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/auth/login":
+			w.Header().Set("x-updated-csrf-token", "csrf-token-abc")
+			_, _ = w.Write([]byte(`{"ok":true}`))
+		case "/proxy/network/api/s/default/cmd/backup":
+			_, _ = w.Write([]byte(`{"meta":{"rc":"error","msg":"api.err.NoPermission"},"data":[]}`))
+		default:
+			t.Fatalf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, ClientOptions{Site: "default"})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := client.Login(context.Background(), "backup", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	_, err = client.CreateBackup(context.Background(), "backup", 0)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Msg != "api.err.NoPermission" {
+		t.Fatalf("CreateBackup() error = %v, want APIError with api.err.NoPermission", err)
+	}
+	if backoff.IsRetryable(err) {
+		t.Error("expected api.err.NoPermission not to be retried")
+	}
+}
+
+func TestAPIErrorRetryable(t *testing.T) {
+	tests := []struct {
+		err  *APIError
+		want bool
+	}{
+		{&APIError{StatusCode: http.StatusUnauthorized}, false},
+		{&APIError{StatusCode: http.StatusForbidden}, false},
+		{&APIError{StatusCode: http.StatusTooManyRequests}, true},
+		{&APIError{StatusCode: http.StatusRequestTimeout}, true},
+		{&APIError{StatusCode: http.StatusBadGateway}, true},
+		{&APIError{StatusCode: http.StatusOK, Msg: "api.err.NoPermission"}, false},
+		{&APIError{StatusCode: http.StatusOK, Msg: "api.err.InvalidPayload"}, false},
+		{&APIError{StatusCode: http.StatusOK, Msg: "api.err.ServerBusy"}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Retryable(); got != tt.want {
+			t.Errorf("Retryable() for status %d, msg %q = %v, want %v", tt.err.StatusCode, tt.err.Msg, got, tt.want)
+		}
+	}
+}
+
+func TestLoginRateLimitCarriesRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "42")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, ClientOptions{Site: "default"})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	err = client.Login(context.Background(), "backup", "secret")
+	if !backoff.IsRetryable(err) {
+		t.Errorf("expected 429 to be retryable, got %v", err)
+	}
+	if got := backoff.RetryAfter(err); got != 42*time.Second {
+		t.Errorf("RetryAfter() = %v, want 42s", got)
+	}
+}
+
+func TestPingDoesNotLogIn(t *testing.T) {
+	t.Parallel()
+
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, ClientOptions{Site: "default"})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := client.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+
+	status.Store(http.StatusBadGateway)
+	if err := client.Ping(context.Background()); err == nil {
+		t.Error("expected Ping() to fail for 502")
+	}
+}
+
+func TestLogoutEndsSession(t *testing.T) {
+	t.Parallel()
+
+	var logouts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/auth/login":
+			w.Header().Set("x-updated-csrf-token", "csrf-1")
+			_, _ = w.Write([]byte(`{}`))
+		case "/api/auth/logout":
+			if r.Method != http.MethodPost || r.Header.Get("X-Csrf-Token") != "csrf-1" {
+				t.Errorf("logout request = %s with CSRF %q", r.Method, r.Header.Get("X-Csrf-Token"))
+			}
+			logouts.Add(1)
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	defer client.Close()
+
+	// Not logged in yet, so there is nothing to end
+	if err := client.Logout(context.Background()); err != nil || logouts.Load() != 0 {
+		t.Fatalf("Logout() before login = %v after %d requests", err, logouts.Load())
+	}
+
+	if err := client.Login(context.Background(), "backup", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if err := client.Logout(context.Background()); err != nil {
+		t.Fatalf("Logout() error = %v", err)
+	}
+	if logouts.Load() != 1 || client.csrf() != "" {
+		t.Errorf("logouts = %d, CSRF token = %q, want 1 and empty", logouts.Load(), client.csrf())
+	}
+	if username, _, _ := client.credentials(); username != "" {
+		t.Error("expected credentials to be cleared")
+	}
+
+	// A second logout does not reach the controller
+	if err := client.Logout(context.Background()); err != nil || logouts.Load() != 1 {
+		t.Errorf("second Logout() = %v after %d requests", err, logouts.Load())
+	}
+}
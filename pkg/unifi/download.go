@@ -0,0 +1,151 @@
+package unifi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+)
+
+// openDownload requests the backup file starting at offset. A non-zero
+// offset is sent as a Range request; when the controller answers with the
+// whole file instead, the first offset bytes are skipped.
+func (c *Client) openDownload(ctx context.Context, backupURL string, offset int64) (*DownloadResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backupURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create download request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	downloadResp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download backup: %w", err)
+	}
+
+	resp := &DownloadResponse{
+		Body:          downloadResp.Body,
+		ContentLength: downloadResp.ContentLength,
+		AcceptRanges:  strings.EqualFold(downloadResp.Header.Get("Accept-Ranges"), "bytes"),
+	}
+
+	switch {
+	case downloadResp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start, end, size int64
+		if _, err := fmt.Sscanf(downloadResp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil || start != offset {
+			downloadResp.Body.Close()
+			return nil, fmt.Errorf("unexpected Content-Range %q for download from byte %d", downloadResp.Header.Get("Content-Range"), offset)
+		}
+		resp.ContentLength = size
+		resp.AcceptRanges = true
+	case downloadResp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			if _, err := io.CopyN(io.Discard, downloadResp.Body, offset); err != nil {
+				downloadResp.Body.Close()
+				return nil, fmt.Errorf("failed to skip %d already downloaded bytes: %w", offset, err)
+			}
+		}
+	default:
+		body, _ := io.ReadAll(downloadResp.Body)
+		downloadResp.Body.Close()
+		return nil, newStatusError("download", downloadResp, body)
+	}
+	return resp, nil
+}
+
+// resumingBody reads a backup download and reopens it at the current offset
+// when the connection breaks
+type resumingBody struct {
+	ctx    context.Context
+	client *Client
+	url    string
+	body   io.ReadCloser
+	// offset is the number of bytes returned so far
+	offset int64
+	// total is the expected size, or -1 when unknown
+	total int64
+	// ranges is set when the controller supports Range requests
+	ranges     bool
+	resumes    int
+	maxResumes int
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if b.total >= 0 && b.offset > b.total {
+			return n, fmt.Errorf("download is longer than the expected %d bytes", b.total)
+		}
+
+		switch {
+		case err == nil:
+			return n, nil
+		case errors.Is(err, io.EOF) && (b.total < 0 || b.offset == b.total):
+			return n, io.EOF
+		case errors.Is(err, io.EOF):
+			err = fmt.Errorf("download ended after %d of %d bytes: %w", b.offset, b.total, io.ErrUnexpectedEOF)
+		}
+
+		if b.ctx.Err() != nil {
+			return n, err
+		}
+		if rerr := b.resume(err); rerr != nil {
+			return n, rerr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the broken body with a new download starting at offset
+func (b *resumingBody) resume(cause error) error {
+	if b.resumes >= b.maxResumes {
+		return fmt.Errorf("download interrupted after %d bytes: %w", b.offset, cause)
+	}
+	b.resumes++
+	b.body.Close()
+
+	slog.Warn("Backup download interrupted, resuming",
+		"error", cause,
+		"offset", b.offset,
+		"range_request", b.ranges,
+		"attempt", b.resumes,
+	)
+
+	offset := b.offset
+	if !b.ranges {
+		// Ask for the whole file and skip what was already read below
+		offset = 0
+	}
+	policy := b.client.download.WithMaxRetries(b.maxResumes - b.resumes)
+	resp, err := backoff.RetryValue(b.ctx, policy, func() (*DownloadResponse, error) {
+		return b.client.openDownload(b.ctx, b.url, offset)
+	})
+	if err != nil {
+		return fmt.Errorf("resume download at byte %d: %w (interrupted by: %v)", b.offset, err, cause)
+	}
+	if !b.ranges && b.offset > 0 {
+		if _, err := io.CopyN(io.Discard, resp.Body, b.offset); err != nil {
+			resp.Body.Close()
+			return fmt.Errorf("resume download at byte %d: skip downloaded bytes: %w", b.offset, err)
+		}
+	}
+	if b.total >= 0 && resp.ContentLength >= 0 && resp.ContentLength != b.total {
+		resp.Body.Close()
+		return fmt.Errorf("backup size changed from %d to %d bytes while resuming", b.total, resp.ContentLength)
+	}
+	b.body = resp.Body
+	return nil
+}
+
+func (b *resumingBody) Close() error {
+	return b.body.Close()
+}
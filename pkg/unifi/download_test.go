@@ -0,0 +1,131 @@
+package unifi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyDownloadServer serves data and breaks the connection halfway through
+// the first request. Range requests are only honoured when ranges is set.
+func flakyDownloadServer(t *testing.T, data []byte, ranges bool) (*httptest.Server, *[]string) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Header.Get("Range"))
+		first := len(requests) == 1
+		mu.Unlock()
+
+		if first {
+			if ranges {
+				w.Header().Set("Accept-Ranges", "bytes")
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("hijack: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+
+		if ranges {
+			http.ServeContent(w, r, "backup.unf", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestDownloadBackupResumesWithRangeRequest(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	server, requests := flakyDownloadServer(t, data, true)
+
+	client, err := NewClient(server.URL, ClientOptions{Site: "default", DownloadRetries: 2})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	resp, err := client.DownloadBackup(context.Background(), server.URL+"/proxy/network/dl/backup/test.unf")
+	if err != nil {
+		t.Fatalf("DownloadBackup() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Fatalf("body has %d bytes, want %d", len(body), len(data))
+	}
+	if len(*requests) != 2 || (*requests)[1] == "" {
+		t.Fatalf("expected a Range request after the interruption, got %q", *requests)
+	}
+}
+
+func TestDownloadBackupRestartsWithoutRangeSupport(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("abcdefghij"), 10000)
+	server, requests := flakyDownloadServer(t, data, false)
+
+	client, err := NewClient(server.URL, ClientOptions{Site: "default", DownloadRetries: 1})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	resp, err := client.DownloadBackup(context.Background(), server.URL+"/proxy/network/dl/backup/test.unf")
+	if err != nil {
+		t.Fatalf("DownloadBackup() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+	if !bytes.Equal(body, data) {
+		t.Fatalf("body has %d bytes, want %d", len(body), len(data))
+	}
+	if len(*requests) != 2 || (*requests)[1] != "" {
+		t.Fatalf("expected a full restart after the interruption, got %q", *requests)
+	}
+}
+
+func TestDownloadBackupFailsWhenRetriesExhausted(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("x"), 100000)
+	server, _ := flakyDownloadServer(t, data, true)
+
+	client, err := NewClient(server.URL, ClientOptions{Site: "default"})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	resp, err := client.DownloadBackup(context.Background(), server.URL+"/proxy/network/dl/backup/test.unf")
+	if err != nil {
+		t.Fatalf("DownloadBackup() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Fatal("expected error for interrupted download")
+	}
+}
@@ -0,0 +1,76 @@
+package unifi
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+)
+
+// APIError is returned when the controller answers a request with an
+// unexpected HTTP status, or with an error code in the response metadata.
+type APIError struct {
+	// Op names the failed request, e.g. "login" or "backup request"
+	Op string
+	// StatusCode and Status are the HTTP status of the response
+	StatusCode int
+	Status     string
+	// Body is the response body of a failed HTTP request
+	Body string
+	// Rc and Msg are the meta.rc and meta.msg fields of an API response,
+	// e.g. "error" and "api.err.NoPermission"
+	Rc  string
+	Msg string
+	// Wait is the delay requested by a Retry-After header
+	Wait time.Duration
+	// Reauthenticated is set when the request was rejected because the
+	// session had expired and the client has logged in again since
+	Reauthenticated bool
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode != http.StatusOK {
+		return fmt.Sprintf("%s failed with status %s: %s", e.Op, e.Status, e.Body)
+	}
+	return fmt.Sprintf("%s failed: response_code=%s, message=%s", e.Op, e.Rc, e.Msg)
+}
+
+// Retryable reports whether repeating the request may succeed. Missing
+// permissions, bad credentials and other client errors are permanent;
+// server errors, rate limits, timeouts and requests rejected by a session
+// that has since been renewed are not.
+func (e *APIError) Retryable() bool {
+	if e.Reauthenticated {
+		return true
+	}
+	if e.Msg == "api.err.NoPermission" || strings.HasPrefix(e.Msg, "api.err.Invalid") {
+		return false
+	}
+	switch {
+	case e.StatusCode == http.StatusRequestTimeout, e.StatusCode == http.StatusTooManyRequests:
+		return true
+	case e.StatusCode >= 400 && e.StatusCode < 500:
+		return false
+	default:
+		return true
+	}
+}
+
+// RetryAfter returns the delay the controller asked for before the next
+// attempt, or zero.
+func (e *APIError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// newStatusError returns an APIError for an unexpected HTTP response
+func newStatusError(op string, resp *http.Response, body []byte) *APIError {
+	return &APIError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(body),
+		Wait:       backoff.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
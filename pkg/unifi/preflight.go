@@ -0,0 +1,282 @@
+package unifi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Preflight failures, matched with errors.Is on a PreflightError
+var (
+	// ErrNotAdministrator means that the account cannot create backups
+	// because it lacks the Administrator role for UniFi Network
+	ErrNotAdministrator = errors.New("account is not a UniFi Network administrator")
+	// ErrSiteNotFound means that the configured site does not exist or is
+	// not visible to the account
+	ErrSiteNotFound = errors.New("site not found")
+)
+
+// PreflightError reports why the account cannot back up the configured site,
+// with a hint on how to fix it. It is never retried.
+type PreflightError struct {
+	// Err is ErrNotAdministrator or ErrSiteNotFound
+	Err error
+	// Detail describes what was found instead
+	Detail string
+	// Hint tells the user how to fix the problem
+	Hint string
+}
+
+func (e *PreflightError) Error() string {
+	return fmt.Sprintf("%v (%s); %s", e.Err, e.Detail, e.Hint)
+}
+
+func (e *PreflightError) Unwrap() error { return e.Err }
+
+// Retryable reports false: the account or site must be changed first
+func (e *PreflightError) Retryable() bool { return false }
+
+// NetworkUser is the logged in user as seen by the UniFi Network application
+type NetworkUser struct {
+	Name string `json:"name"`
+	// SiteRole is the role on the user's current site, e.g. admin or
+	// readonly. Site administrators have the admin site role, too.
+	SiteRole string `json:"site_role"`
+	// IsSuper is set for super administrators of the whole application
+	IsSuper bool `json:"is_super"`
+}
+
+// ConsoleUser is the logged in user as seen by UniFi OS
+type ConsoleUser struct {
+	Username     string `json:"username"`
+	IsOwner      bool   `json:"isOwner"`
+	IsSuperAdmin bool   `json:"isSuperAdmin"`
+	Roles        []struct {
+		Name string `json:"name"`
+	} `json:"roles"`
+	// Permissions maps each application, e.g. network.management, to the
+	// permissions the user has in it
+	Permissions map[string][]string `json:"permissions"`
+}
+
+// Site is a UniFi Network site visible to the logged in user
+type Site struct {
+	ID string `json:"_id"`
+	// Name is the short name used in API paths and unifi.site
+	Name string `json:"name"`
+	// Desc is the display name shown in the UI
+	Desc string `json:"desc"`
+	Role string `json:"role"`
+}
+
+// Account summarizes the checks of Preflight
+type Account struct {
+	Network NetworkUser
+	// Console is nil when the UniFi OS user endpoint is not available
+	Console *ConsoleUser
+	Site    Site
+}
+
+// Preflight checks that the logged in account may create backups of the
+// configured site, so that a run fails before triggering the backup. It
+// returns a *PreflightError when the account clearly lacks the
+// Administrator role or the site does not exist. When the roles do not tell,
+// it only logs a warning.
+func (c *Client) Preflight(ctx context.Context) (*Account, error) {
+	network, err := c.Self(ctx)
+	if err != nil {
+		return nil, err
+	}
+	account := &Account{Network: *network}
+
+	// The UniFi OS user adds roles and permissions, but is not available on
+	// every console
+	if account.Console, err = c.ConsoleUser(ctx); err != nil {
+		slog.Debug("Failed to read UniFi OS user", "error", err)
+	}
+
+	switch admin, known := account.IsAdministrator(); {
+	case !known:
+		slog.Warn("Cannot tell whether the account may create backups, trying anyway",
+			"detail", account.roleDetail(),
+		)
+	case !admin:
+		return account, &PreflightError{
+			Err:    ErrNotAdministrator,
+			Detail: account.roleDetail(),
+			Hint:   "in UniFi OS, give the user the Administrator (Full Management) role for UniFi Network; Site Administrators and read-only users cannot create backups",
+		}
+	}
+
+	sites, err := c.Sites(ctx)
+	if err != nil {
+		return account, err
+	}
+	var names []string
+	for _, site := range sites {
+		if site.Name == c.site {
+			account.Site = site
+			return account, nil
+		}
+		names = append(names, site.Name)
+	}
+	hint := fmt.Sprintf("set unifi.site to one of: %s", strings.Join(names, ", "))
+	for _, site := range sites {
+		if strings.EqualFold(site.Desc, c.site) {
+			hint = fmt.Sprintf("unifi.site takes the short site name from the URL; use %q for %q", site.Name, site.Desc)
+		}
+	}
+	return account, &PreflightError{
+		Err:    ErrSiteNotFound,
+		Detail: fmt.Sprintf("no site named %q", c.site),
+		Hint:   hint,
+	}
+}
+
+// IsAdministrator reports whether the account may create backups, that is
+// whether it has full management of UniFi Network. known is false when the
+// roles and permissions reported by the console do not tell, e.g. for an
+// admin site role without a UniFi OS user. Any sign of full management wins
+// over signs of a restricted role.
+func (a *Account) IsAdministrator() (admin, known bool) {
+	if a.Network.IsSuper || (a.Console != nil && (a.Console.IsOwner || a.Console.IsSuperAdmin)) {
+		return true, true
+	}
+
+	restricted := false
+	if a.Console != nil {
+		for _, permission := range a.Console.Permissions["network.management"] {
+			switch strings.ToLower(permission) {
+			case "admin", "full_management":
+				return true, true
+			case "readonly", "read_only", "view_only":
+				restricted = true
+			}
+		}
+		for _, role := range a.Console.Roles {
+			name := strings.ToLower(role.Name)
+			switch {
+			case strings.Contains(name, "site admin"), strings.Contains(name, "view only"),
+				strings.Contains(name, "read only"), strings.Contains(name, "readonly"):
+				restricted = true
+			case strings.Contains(name, "full management"), strings.Contains(name, "super admin"),
+				name == "administrator", name == "admin", name == "owner":
+				return true, true
+			}
+		}
+	}
+
+	// The admin site role is shared by site and full administrators
+	if a.Network.SiteRole != "" && a.Network.SiteRole != "admin" {
+		restricted = true
+	}
+	if restricted {
+		return false, true
+	}
+	return false, false
+}
+
+// roleDetail describes the roles of the account for errors and warnings
+func (a *Account) roleDetail() string {
+	detail := fmt.Sprintf("user %q has site role %q", a.Network.Name, a.Network.SiteRole)
+	if a.Console == nil {
+		return detail + " and no UniFi OS user information"
+	}
+	if len(a.Console.Roles) > 0 {
+		var roles []string
+		for _, role := range a.Console.Roles {
+			roles = append(roles, role.Name)
+		}
+		detail += fmt.Sprintf(" and UniFi OS roles %s", strings.Join(roles, ", "))
+	}
+	if permissions := a.Console.Permissions["network.management"]; len(permissions) > 0 {
+		detail += fmt.Sprintf(" with UniFi Network permissions %s", strings.Join(permissions, ", "))
+	}
+	return detail
+}
+
+// Self returns the logged in user from the Network application. It is also
+// a cheap check that the session is valid.
+func (c *Client) Self(ctx context.Context) (*NetworkUser, error) {
+	var users []NetworkUser
+	if err := c.getNetwork(ctx, "self", "/api/self", &users); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, errors.New("self response contains no user")
+	}
+	return &users[0], nil
+}
+
+// Sites returns the Network application sites visible to the logged in user
+func (c *Client) Sites(ctx context.Context) ([]Site, error) {
+	var sites []Site
+	if err := c.getNetwork(ctx, "sites", "/api/self/sites", &sites); err != nil {
+		return nil, err
+	}
+	return sites, nil
+}
+
+// ConsoleUser returns the logged in user from UniFi OS
+func (c *Client) ConsoleUser(ctx context.Context) (*ConsoleUser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/users/self", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user request: %w", err)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("user request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError("user request", resp, body)
+	}
+
+	var user ConsoleUser
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, fmt.Errorf("failed to decode user response: %w", err)
+	}
+	return &user, nil
+}
+
+// getNetwork sends a GET request to a Network application endpoint and
+// decodes the data of its meta/data envelope into data
+func (c *Client) getNetwork(ctx context.Context, op, path string, data any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+networkProxyPrefix+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %w", op, err)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %w", op, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(op+" request", resp, body)
+	}
+
+	var result struct {
+		Meta struct {
+			Rc  string `json:"rc"`
+			Msg string `json:"msg,omitempty"`
+		} `json:"meta"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", op, err)
+	}
+	if result.Meta.Rc != "ok" {
+		return &APIError{Op: op, StatusCode: resp.StatusCode, Status: resp.Status, Rc: result.Meta.Rc, Msg: result.Meta.Msg}
+	}
+	if err := json.Unmarshal(result.Data, data); err != nil {
+		return fmt.Errorf("failed to decode %s data: %w", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package unifi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+)
+
+// preflightServer answers the preflight endpoints with the given Network
+// user and UniFi OS user; an empty console response is a 404
+func preflightServer(t *testing.T, self, console string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/auth/login":
+			w.Header().Set("x-updated-csrf-token", "csrf-1")
+			_, _ = w.Write([]byte(`{}`))
+		case "/proxy/network/api/self":
+			_, _ = w.Write([]byte(`{"meta":{"rc":"ok"},"data":[` + self + `]}`))
+		case "/proxy/network/api/self/sites":
+			_, _ = w.Write([]byte(`{"meta":{"rc":"ok"},"data":[{"_id":"1","name":"default","desc":"Default","role":"admin"},{"_id":"2","name":"x7kq2c9a","desc":"Branch Office","role":"admin"}]}`))
+		case "/api/users/self":
+			if console == "" {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write([]byte(console))
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func preflight(t *testing.T, server *httptest.Server, site string) (*Account, error) {
+	t.Helper()
+
+	client, _ := NewClient(server.URL, ClientOptions{Site: site})
+	if err := client.Login(context.Background(), "backup", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	return client.Preflight(context.Background())
+}
+
+func TestPreflightAcceptsAdministrator(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		self, console string
+	}{
+		"network super admin": {self: `{"name":"backup","site_role":"admin","is_super":true}`},
+		"console owner":       {self: `{"name":"backup","site_role":"admin"}`, console: `{"username":"backup","isOwner":true}`},
+		"full management role": {
+			self:    `{"name":"backup","site_role":"admin"}`,
+			console: `{"username":"backup","roles":[{"name":"Network Administrator (Full Management)"}]}`,
+		},
+		"network admin permission": {
+			self:    `{"name":"backup","site_role":"admin"}`,
+			console: `{"username":"backup","roles":[{"name":"Backup"}],"permissions":{"network.management":["admin"]}}`,
+		},
+		// Without UniFi OS roles, the admin site role cannot tell site
+		// administrators apart, so the run goes ahead
+		"unclear roles": {self: `{"name":"backup","site_role":"admin"}`},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			account, err := preflight(t, preflightServer(t, tt.self, tt.console), "x7kq2c9a")
+			if err != nil {
+				t.Fatalf("Preflight() error = %v", err)
+			}
+			if account.Site.Desc != "Branch Office" || account.Network.Name != "backup" {
+				t.Errorf("Preflight() = %+v", account)
+			}
+		})
+	}
+}
+
+func TestPreflightRejectsRestrictedRoles(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		self, console, wantDetail string
+	}{
+		"site administrator": {
+			self:       `{"name":"backup","site_role":"admin","is_super":false}`,
+			console:    `{"username":"backup","roles":[{"name":"Site Admin"}]}`,
+			wantDetail: "Site Admin",
+		},
+		"read-only site role": {
+			self:       `{"name":"backup","site_role":"readonly"}`,
+			wantDetail: `"readonly"`,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := preflight(t, preflightServer(t, tt.self, tt.console), "default")
+			var preflightErr *PreflightError
+			if !errors.Is(err, ErrNotAdministrator) || !errors.As(err, &preflightErr) {
+				t.Fatalf("Preflight() error = %v, want ErrNotAdministrator", err)
+			}
+			if !strings.Contains(preflightErr.Detail, tt.wantDetail) || preflightErr.Hint == "" {
+				t.Errorf("Detail = %q, Hint = %q", preflightErr.Detail, preflightErr.Hint)
+			}
+			if backoff.IsRetryable(err) {
+				t.Error("expected preflight error not to be retried")
+			}
+		})
+	}
+}
+
+func TestPreflightRejectsUnknownSite(t *testing.T) {
+	t.Parallel()
+
+	server := preflightServer(t, `{"name":"backup","site_role":"admin","is_super":true}`, "")
+
+	_, err := preflight(t, server, "Branch Office")
+	var preflightErr *PreflightError
+	if !errors.Is(err, ErrSiteNotFound) || !errors.As(err, &preflightErr) {
+		t.Fatalf("Preflight() error = %v, want ErrSiteNotFound", err)
+	}
+	// The display name points to the short name
+	if !strings.Contains(preflightErr.Hint, `"x7kq2c9a"`) {
+		t.Errorf("Hint = %q, want the short site name", preflightErr.Hint)
+	}
+
+	_, err = preflight(t, server, "warehouse")
+	if !errors.As(err, &preflightErr) || !strings.Contains(preflightErr.Hint, "default, x7kq2c9a") {
+		t.Errorf("Preflight() error = %v, want the available sites", err)
+	}
+}
@@ -0,0 +1,121 @@
+package unifi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// maxCSRFErrorBody bounds how much of a 403 response is read to tell a CSRF
+// mismatch from missing permissions
+const maxCSRFErrorBody = 4096
+
+// setCredentials stores the credentials of a successful login and starts a
+// new session generation
+func (c *Client) setCredentials(username, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username = username
+	c.password = password
+	c.generation++
+}
+
+// credentials returns the stored credentials and the current session
+// generation
+func (c *Client) credentials() (username, password string, generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.username, c.password, c.generation
+}
+
+// do sends req like send. When the session has expired, it logs in again
+// once with the credentials of the last successful login.
+//
+// Idempotent requests are then replayed. Other requests fail with an
+// APIError whose Reauthenticated field is set, so that the caller's retry
+// policy can decide whether to send them again.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	_, _, generation := c.credentials()
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if !sessionExpired(resp) {
+		return resp, nil
+	}
+	username, password, _ := c.credentials()
+	if username == "" {
+		return resp, nil
+	}
+
+	slog.Info("Controller session expired, logging in again", "status", resp.Status, "path", req.URL.Path)
+	if err := c.relogin(req, generation, username, password); err != nil {
+		slog.Warn("Failed to log in again", "error", err)
+		return resp, nil
+	}
+
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	if !isIdempotent(req.Method) || !replayable {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxCSRFErrorBody))
+		resp.Body.Close()
+		apiErr := newStatusError(req.Method+" "+req.URL.Path, resp, body)
+		apiErr.Reauthenticated = true
+		return nil, apiErr
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	replay := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if replay.Body, err = req.GetBody(); err != nil {
+			return nil, fmt.Errorf("replay request: %w", err)
+		}
+	}
+	return c.send(replay)
+}
+
+// relogin logs in again unless another request already did so since req
+// was sent during session generation
+func (c *Client) relogin(req *http.Request, generation int, username, password string) error {
+	c.loginMu.Lock()
+	defer c.loginMu.Unlock()
+	if _, _, current := c.credentials(); current != generation {
+		return nil
+	}
+	return c.Login(req.Context(), username, password)
+}
+
+// sessionExpired reports whether resp rejects the session: a 401, or a 403
+// caused by a CSRF token mismatch. For a 403 the body is read and replaced
+// so that the caller can still read it.
+func sessionExpired(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusForbidden:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxCSRFErrorBody))
+		resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return strings.Contains(strings.ToLower(string(body)), "csrf")
+	}
+	return false
+}
+
+// prefixedBody reads an already buffered prefix followed by the rest of a
+// response body, and closes the original body
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// isIdempotent reports whether a request with method may be sent twice
+// without changing the outcome
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package unifi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+)
+
+// expiringServer issues a new session on every login and expires the first
+// one after the first request to any other endpoint. rejection writes the
+// response for an expired session.
+func expiringServer(t *testing.T, rejection func(w http.ResponseWriter)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var logins, requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth/login" {
+			n := logins.Add(1)
+			w.Header().Set("x-updated-csrf-token", fmt.Sprintf("csrf-%d", n))
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		if r.URL.Path == "/api/system" {
+			http.NotFound(w, r)
+			return
+		}
+		if requests.Add(1) > 1 && r.Header.Get("X-Csrf-Token") == "csrf-1" {
+			rejection(w)
+			return
+		}
+		switch r.URL.Path {
+		case "/proxy/network/api/s/default/stat/sysinfo":
+			_, _ = w.Write([]byte(`{"meta":{"rc":"ok"},"data":[{"version":"9.0.114","hostname":"udm"}]}`))
+		case "/proxy/network/api/s/default/cmd/backup":
+			_, _ = w.Write([]byte(`{"meta":{"rc":"ok"},"data":[{"url":"/dl/backup/test.unf"}]}`))
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &logins
+}
+
+func TestClientReplaysIdempotentRequestAfterRelogin(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]func(w http.ResponseWriter){
+		"unauthorized": func(w http.ResponseWriter) { w.WriteHeader(http.StatusUnauthorized) },
+		"csrf mismatch": func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":"Invalid CSRF Token"}`))
+		},
+	}
+	for name, rejection := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server, logins := expiringServer(t, rejection)
+			client, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+			if err := client.Login(context.Background(), "backup", "secret"); err != nil {
+				t.Fatalf("Login() error = %v", err)
+			}
+			if _, err := client.SystemInfo(context.Background()); err != nil {
+				t.Fatalf("first SystemInfo() error = %v", err)
+			}
+
+			info, err := client.SystemInfo(context.Background())
+			if err != nil {
+				t.Fatalf("SystemInfo() after expiry error = %v", err)
+			}
+			if info.Version != "9.0.114" || logins.Load() != 2 {
+				t.Errorf("version = %q, logins = %d, want 9.0.114 after 2 logins", info.Version, logins.Load())
+			}
+		})
+	}
+}
+
+func TestClientRetriesNonIdempotentRequestAfterRelogin(t *testing.T) {
+	t.Parallel()
+
+	server, logins := expiringServer(t, func(w http.ResponseWriter) { w.WriteHeader(http.StatusUnauthorized) })
+	client, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	if err := client.Login(context.Background(), "backup", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if _, err := client.SystemInfo(context.Background()); err != nil {
+		t.Fatalf("SystemInfo() error = %v", err)
+	}
+
+	// The backup request is not replayed, but reported as retryable
+	_, err := client.CreateBackup(context.Background(), "backup", 0)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.Reauthenticated || !backoff.IsRetryable(err) {
+		t.Fatalf("CreateBackup() error = %v, want retryable reauthenticated APIError", err)
+	}
+	if logins.Load() != 2 {
+		t.Errorf("logins = %d, want 2", logins.Load())
+	}
+
+	if _, err := client.CreateBackup(context.Background(), "backup", 0); err != nil {
+		t.Errorf("CreateBackup() with new session error = %v", err)
+	}
+}
+
+func TestClientDoesNotReloginForMissingPermissions(t *testing.T) {
+	t.Parallel()
+
+	server, logins := expiringServer(t, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"meta":{"rc":"error","msg":"api.err.NoPermission"}}`))
+	})
+	client, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	if err := client.Login(context.Background(), "backup", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	_, _ = client.SystemInfo(context.Background())
+
+	_, err := client.SystemInfo(context.Background())
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("SystemInfo() error = %v, want 403 APIError", err)
+	}
+	if logins.Load() != 1 {
+		t.Errorf("logins = %d, want 1", logins.Load())
+	}
+}
+
+// closeCounter counts the calls to Close of a response body
+type closeCounter struct {
+	io.Reader
+	closes int
+}
+
+func (c *closeCounter) Close() error {
+	c.closes++
+	return nil
+}
+
+func TestSessionExpiredKeepsBodyReadableAndClosable(t *testing.T) {
+	t.Parallel()
+
+	const text = `{"meta":{"rc":"error","msg":"api.err.NoPermission"}}`
+	original := &closeCounter{Reader: strings.NewReader(text)}
+	resp := &http.Response{StatusCode: http.StatusForbidden, Body: original}
+
+	if sessionExpired(resp) {
+		t.Error("sessionExpired() = true for a 403 without CSRF error")
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != text {
+		t.Errorf("body after sessionExpired() = %q, %v, want %q", body, err, text)
+	}
+	resp.Body.Close()
+	if original.closes != 1 {
+		t.Errorf("original body closed %d times, want 1", original.closes)
+	}
+}
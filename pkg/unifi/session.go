@@ -0,0 +1,313 @@
+package unifi
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// sessionMagic starts every session file and names its format version
+const sessionMagic = "unifi-backup-session-v2\n"
+
+const sessionSaltSize = 16
+
+// sessionKDFSize is the size of the encoded sessionKDF that follows
+// sessionMagic: time, memory, threads and salt
+const sessionKDFSize = 4 + 4 + 1 + sessionSaltSize
+
+// Upper bounds for the KDF parameters read from a session file, so that a
+// corrupt file cannot exhaust memory or CPU
+const (
+	maxSessionKDFTime   = 16
+	maxSessionKDFMemory = 1 << 20 // 1 GiB
+)
+
+// sessionKDF holds the argon2id parameters that derive the session file key
+// from the password. They are stored in the file header, so that they can
+// be raised without making existing files unreadable.
+type sessionKDF struct {
+	Time uint32
+	// Memory is in KiB
+	Memory  uint32
+	Threads uint8
+	Salt    []byte
+}
+
+// newSessionKDF returns the parameters for a new session file, following
+// the second recommendation of RFC 9106, with a random salt
+func newSessionKDF() (sessionKDF, error) {
+	kdf := sessionKDF{Time: 3, Memory: 64 * 1024, Threads: 4, Salt: make([]byte, sessionSaltSize)}
+	if _, err := rand.Read(kdf.Salt); err != nil {
+		return kdf, fmt.Errorf("generate salt: %w", err)
+	}
+	return kdf, nil
+}
+
+// marshal encodes the parameters for the file header
+func (k sessionKDF) marshal() []byte {
+	b := binary.BigEndian.AppendUint32(nil, k.Time)
+	b = binary.BigEndian.AppendUint32(b, k.Memory)
+	b = append(b, k.Threads)
+	return append(b, k.Salt...)
+}
+
+// parseSessionKDF decodes and checks the parameters from a file header
+func parseSessionKDF(b []byte) (sessionKDF, error) {
+	kdf := sessionKDF{
+		Time:    binary.BigEndian.Uint32(b[0:4]),
+		Memory:  binary.BigEndian.Uint32(b[4:8]),
+		Threads: b[8],
+		Salt:    b[9:sessionKDFSize],
+	}
+	if kdf.Time == 0 || kdf.Time > maxSessionKDFTime || kdf.Memory == 0 || kdf.Memory > maxSessionKDFMemory || kdf.Threads == 0 {
+		return kdf, fmt.Errorf("session file has invalid key derivation parameters (time %d, memory %d KiB, threads %d)", kdf.Time, kdf.Memory, kdf.Threads)
+	}
+	return kdf, nil
+}
+
+// errNoSessionPassword is returned when there is no password to derive the
+// session file key from
+var errNoSessionPassword = errors.New("no password set to encrypt the session with")
+
+// sessionCache remembers the key derived for the session file last read or
+// written, so that saving again does not repeat the slow key derivation,
+// and the session that file holds, so that an unchanged session is not
+// written again
+type sessionCache struct {
+	password string
+	header   []byte
+	aead     cipher.AEAD
+	// path and state identify the saved session; state is the encoded
+	// savedSession without SavedAt
+	path  string
+	state []byte
+}
+
+// savedSession is the plaintext content of a session file
+type savedSession struct {
+	BaseURL   string         `json:"baseUrl"`
+	Username  string         `json:"username"`
+	CSRFToken string         `json:"csrfToken"`
+	Cookies   []*http.Cookie `json:"cookies"`
+	SavedAt   time.Time      `json:"savedAt"`
+}
+
+// SaveSession writes the session cookies and CSRF token to the file at path
+// so that a later run can reuse the session with RestoreSession instead of
+// logging in again.
+//
+// The file is encrypted with AES-256-GCM using a key derived from password
+// with argon2id, and written with mode 0600. Without a password the session
+// is not saved. The key is derived once per client and password, and a
+// session that has not changed since it was last saved to or restored from
+// path is not written again.
+func (c *Client) SaveSession(path, username, password string) error {
+	if password == "" {
+		return errNoSessionPassword
+	}
+	base, err := url.Parse(c.baseURL)
+	if err != nil {
+		return fmt.Errorf("parse controller URL: %w", err)
+	}
+	var cookies []*http.Cookie
+	for _, cookie := range c.httpClient.Jar.Cookies(base) {
+		cookies = append(cookies, &http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	session := savedSession{
+		BaseURL:   c.baseURL,
+		Username:  username,
+		CSRFToken: c.csrf(),
+		Cookies:   cookies,
+	}
+	state, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("encode session: %w", err)
+	}
+
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	cache := c.sessionCache
+	if cache != nil && cache.password == password && cache.path == path && bytes.Equal(cache.state, state) {
+		return nil
+	}
+	if cache == nil || cache.password != password {
+		kdf, err := newSessionKDF()
+		if err != nil {
+			return err
+		}
+		aead, err := kdf.cipher(password)
+		if err != nil {
+			return err
+		}
+		cache = &sessionCache{
+			password: password,
+			header:   append([]byte(sessionMagic), kdf.marshal()...),
+			aead:     aead,
+		}
+	}
+
+	session.SavedAt = time.Now().UTC()
+	plain, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("encode session: %w", err)
+	}
+	nonce := make([]byte, cache.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generate nonce: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(cache.header)
+	buf.Write(nonce)
+	buf.Write(cache.aead.Seal(nil, nonce, plain, sessionAdditionalData(cache.header, c.baseURL)))
+
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return err
+	}
+	cache.path, cache.state = path, state
+	c.sessionCache = cache
+	return nil
+}
+
+// RestoreSession loads a session saved with SaveSession and checks with the
+// controller that it is still valid. It reports false, and leaves the client
+// logged out, when there is no saved session, it belongs to another
+// controller or user, or it has expired; the caller should then Login.
+func (c *Client) RestoreSession(ctx context.Context, path, username, password string) (bool, error) {
+	if password == "" {
+		return false, errNoSessionPassword
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read session: %w", err)
+	}
+
+	session, cache, err := decryptSession(data, password, c.baseURL)
+	if err != nil {
+		return false, err
+	}
+	// Later saves reuse the key, and skip the write while the session is
+	// the one in the file
+	saved := *session
+	saved.SavedAt = time.Time{}
+	if cache.state, err = json.Marshal(saved); err != nil {
+		return false, fmt.Errorf("encode session: %w", err)
+	}
+	cache.path = path
+	c.sessionMu.Lock()
+	c.sessionCache = cache
+	c.sessionMu.Unlock()
+	if session.BaseURL != c.baseURL || session.Username != username {
+		slog.Info("Saved session belongs to another controller or user, logging in")
+		return false, nil
+	}
+
+	base, err := url.Parse(c.baseURL)
+	if err != nil {
+		return false, fmt.Errorf("parse controller URL: %w", err)
+	}
+	c.httpClient.Jar.SetCookies(base, session.Cookies)
+	c.setCSRF(session.CSRFToken)
+
+	if _, err := c.Self(ctx); err != nil {
+		c.setCSRF("")
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden) {
+			slog.Info("Saved session has expired, logging in", "saved_at", session.SavedAt)
+			return false, nil
+		}
+		return false, fmt.Errorf("validate session: %w", err)
+	}
+
+	c.setCredentials(username, password)
+	slog.Info("Reusing saved session", "username", username, "saved_at", session.SavedAt)
+	return true, nil
+}
+
+// cipher derives the session file key from password
+func (k sessionKDF) cipher(password string) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(password), k.Salt, k.Time, k.Memory, k.Threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("create session cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// sessionAdditionalData authenticates the file header along with the
+// session and binds both to the controller URL
+func sessionAdditionalData(header []byte, baseURL string) []byte {
+	return append(append([]byte{}, header...), baseURL...)
+}
+
+// decryptSession decrypts and decodes the content of a session file. It
+// also returns the derived key for reuse by SaveSession.
+func decryptSession(data []byte, password, baseURL string) (*savedSession, *sessionCache, error) {
+	rest, ok := bytes.CutPrefix(data, []byte(sessionMagic))
+	if !ok || len(rest) < sessionKDFSize {
+		return nil, nil, errors.New("session file has an unknown format")
+	}
+	header := bytes.Clone(data[:len(sessionMagic)+sessionKDFSize])
+	kdf, err := parseSessionKDF(rest[:sessionKDFSize])
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := kdf.cipher(password)
+	if err != nil {
+		return nil, nil, err
+	}
+	rest = rest[sessionKDFSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, nil, errors.New("session file is truncated")
+	}
+	nonce, sealed := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, sessionAdditionalData(header, baseURL))
+	if err != nil {
+		// Also the result of a changed password or controller URL
+		return nil, nil, errors.New("session file cannot be decrypted")
+	}
+
+	var session savedSession
+	if err := json.Unmarshal(plain, &session); err != nil {
+		return nil, nil, fmt.Errorf("decode session: %w", err)
+	}
+	return &session, &sessionCache{password: password, header: header, aead: aead}, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path with mode
+// 0600 and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package unifi
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// sessionServer accepts logins and answers /api/self for the issued session
+// cookie until expired is set
+func sessionServer(t *testing.T) (*httptest.Server, *atomic.Int32, *atomic.Bool) {
+	t.Helper()
+
+	var logins atomic.Int32
+	var expired atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/auth/login":
+			logins.Add(1)
+			http.SetCookie(w, &http.Cookie{Name: "TOKEN", Value: "session-1", Path: "/"})
+			w.Header().Set("x-updated-csrf-token", "csrf-1")
+			_, _ = w.Write([]byte(`{}`))
+		case "/proxy/network/api/self":
+			cookie, err := r.Cookie("TOKEN")
+			if expired.Load() || err != nil || cookie.Value != "session-1" || r.Header.Get("X-Csrf-Token") != "csrf-1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("x-updated-csrf-token", "csrf-2")
+			_, _ = w.Write([]byte(`{"meta":{"rc":"ok"},"data":[{"name":"backup"}]}`))
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &logins, &expired
+}
+
+func TestRestoreSessionReusesSavedSession(t *testing.T) {
+	t.Parallel()
+
+	server, logins, _ := sessionServer(t)
+	path := filepath.Join(t.TempDir(), "session")
+
+	first, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	if err := first.Login(context.Background(), "backup", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if err := first.SaveSession(path, "backup", "secret"); err != nil {
+		t.Fatalf("SaveSession() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "session-1") || strings.Contains(string(data), "csrf-1") {
+		t.Error("session file contains the session in plain text")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("session file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	second, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	ok, err := second.RestoreSession(context.Background(), path, "backup", "secret")
+	if err != nil || !ok {
+		t.Fatalf("RestoreSession() = %v, %v, want true", ok, err)
+	}
+	if logins.Load() != 1 {
+		t.Errorf("logins = %d, want 1", logins.Load())
+	}
+	// The token is refreshed from x-updated-csrf-token
+	if got := second.csrf(); got != "csrf-2" {
+		t.Errorf("CSRF token = %q, want csrf-2", got)
+	}
+}
+
+func TestRestoreSessionRejectsExpiredOrForeignSessions(t *testing.T) {
+	t.Parallel()
+
+	server, _, expired := sessionServer(t)
+	path := filepath.Join(t.TempDir(), "session")
+
+	client, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	ok, err := client.RestoreSession(context.Background(), path, "backup", "secret")
+	if ok || err != nil {
+		t.Errorf("RestoreSession() without file = %v, %v, want false, nil", ok, err)
+	}
+
+	if err := client.Login(context.Background(), "backup", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if err := client.SaveSession(path, "backup", "secret"); err != nil {
+		t.Fatalf("SaveSession() error = %v", err)
+	}
+
+	fresh, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	if ok, err := fresh.RestoreSession(context.Background(), path, "backup", "changed"); ok || err == nil {
+		t.Errorf("RestoreSession() with another password = %v, %v, want decryption error", ok, err)
+	}
+	if ok, err := fresh.RestoreSession(context.Background(), path, "admin", "secret"); ok || err != nil {
+		t.Errorf("RestoreSession() for another user = %v, %v, want false, nil", ok, err)
+	}
+
+	expired.Store(true)
+	ok, err = fresh.RestoreSession(context.Background(), path, "backup", "secret")
+	if ok || err != nil {
+		t.Errorf("RestoreSession() of expired session = %v, %v, want false, nil", ok, err)
+	}
+	if fresh.csrf() != "" {
+		t.Error("expected CSRF token of expired session to be cleared")
+	}
+}
+
+func TestSaveSessionReusesKeyAndSkipsUnchangedSession(t *testing.T) {
+	t.Parallel()
+
+	server, _, _ := sessionServer(t)
+	path := filepath.Join(t.TempDir(), "session")
+
+	client, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	if err := client.Login(context.Background(), "backup", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if err := client.SaveSession(path, "backup", "secret"); err != nil {
+		t.Fatalf("SaveSession() error = %v", err)
+	}
+	first, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changed, so the file is not rewritten
+	if err := client.SaveSession(path, "backup", "secret"); err != nil {
+		t.Fatalf("SaveSession() error = %v", err)
+	}
+	if again, _ := os.ReadFile(path); !bytes.Equal(again, first) {
+		t.Error("unchanged session was written again")
+	}
+
+	headerSize := len(sessionMagic) + sessionKDFSize
+
+	// Saving after a restore reuses the key read from the file
+	restored, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	if ok, err := restored.RestoreSession(context.Background(), path, "backup", "secret"); err != nil || !ok {
+		t.Fatalf("RestoreSession() = %v, %v, want true", ok, err)
+	}
+	if err := restored.SaveSession(path, "backup", "secret"); err != nil {
+		t.Fatalf("SaveSession() error = %v", err)
+	}
+	// The restore refreshed the CSRF token, so the session is written
+	resaved, _ := os.ReadFile(path)
+	if bytes.Equal(resaved, first) {
+		t.Error("refreshed session was not written")
+	}
+	if !bytes.Equal(resaved[:headerSize], first[:headerSize]) {
+		t.Error("save after restore derived a new key")
+	}
+
+	// A refreshed CSRF token is saved with the key derived before
+	client.setCSRF("csrf-2")
+	if err := client.SaveSession(path, "backup", "secret"); err != nil {
+		t.Fatalf("SaveSession() error = %v", err)
+	}
+	refreshed, _ := os.ReadFile(path)
+	if bytes.Equal(refreshed, first) {
+		t.Error("changed session was not written")
+	}
+	if !bytes.Equal(refreshed[:headerSize], first[:headerSize]) {
+		t.Error("second save derived a new key")
+	}
+}
+
+func TestSaveSessionRequiresPassword(t *testing.T) {
+	t.Parallel()
+
+	server, _, _ := sessionServer(t)
+	path := filepath.Join(t.TempDir(), "session")
+
+	client, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	if err := client.Login(context.Background(), "backup", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if err := client.SaveSession(path, "backup", ""); err == nil {
+		t.Error("SaveSession() without password succeeded, want error")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("session file was written without password, stat error = %v", err)
+	}
+	if ok, err := client.RestoreSession(context.Background(), path, "backup", ""); ok || err == nil {
+		t.Errorf("RestoreSession() without password = %v, %v, want error", ok, err)
+	}
+}
+
+func TestRestoreSessionRejectsTamperedHeader(t *testing.T) {
+	t.Parallel()
+
+	server, _, _ := sessionServer(t)
+	path := filepath.Join(t.TempDir(), "session")
+
+	client, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+	if err := client.Login(context.Background(), "backup", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if err := client.SaveSession(path, "backup", "secret"); err != nil {
+		t.Fatalf("SaveSession() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func([]byte){
+		// Weaker parameters must not be accepted silently
+		"lowered time cost": func(b []byte) { b[len(sessionMagic)+3] = 1 },
+		"excessive memory":  func(b []byte) { b[len(sessionMagic)+4] = 0xff },
+		"no threads":        func(b []byte) { b[len(sessionMagic)+8] = 0 },
+		"older format":      func(b []byte) { copy(b, "unifi-backup-session-v1\n") },
+	}
+	for name, tamper := range tests {
+		tampered := append([]byte{}, data...)
+		tamper(tampered)
+		if err := os.WriteFile(path, tampered, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		fresh, _ := NewClient(server.URL, ClientOptions{Site: "default"})
+		if ok, err := fresh.RestoreSession(context.Background(), path, "backup", "secret"); ok || err == nil {
+			t.Errorf("%s: RestoreSession() = %v, %v, want error", name, ok, err)
+		}
+	}
+}
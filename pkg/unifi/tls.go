@@ -0,0 +1,170 @@
+package unifi
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Fingerprint is the SHA-256 fingerprint of a certificate or of its public
+// key (SPKI)
+type Fingerprint [sha256.Size]byte
+
+// ParseFingerprint parses a SHA-256 fingerprint in hex, with or without
+// colons, e.g. as printed by the trust subcommand or openssl
+func ParseFingerprint(s string) (Fingerprint, error) {
+	var fp Fingerprint
+	raw, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+	if err != nil || len(raw) != len(fp) {
+		return fp, fmt.Errorf("invalid SHA-256 fingerprint %q: want 64 hex digits", s)
+	}
+	copy(fp[:], raw)
+	return fp, nil
+}
+
+// String formats the fingerprint as colon-separated uppercase hex
+func (fp Fingerprint) String() string {
+	parts := make([]string, len(fp))
+	for i, b := range fp {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the whole
+// certificate
+func CertificateFingerprint(cert *x509.Certificate) Fingerprint {
+	return sha256.Sum256(cert.Raw)
+}
+
+// SPKIFingerprint returns the SHA-256 fingerprint of the certificate's public
+// key. Unlike the certificate fingerprint it survives certificate renewals
+// that keep the key.
+func SPKIFingerprint(cert *x509.Certificate) Fingerprint {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// newTLSConfig builds the TLS configuration for the controller connection.
+//
+// CAFile adds certificates to the system roots, and ClientCertFile is
+// presented for mutual TLS. With PinnedSHA256 the
+// controller's certificate must match one of the pins; unless CAFile is set
+// as well, the chain is then not verified, so that pinned self-signed
+// certificates are accepted.
+func newTLSConfig(opts ClientOptions) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA file %s contains no PEM certificates", opts.CAFile)
+		}
+		config.RootCAs = pool
+		config.InsecureSkipVerify = false
+	}
+
+	if opts.ClientCertFile != "" {
+		keyFile := opts.ClientKeyFile
+		if keyFile == "" {
+			keyFile = opts.ClientCertFile
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.PinnedSHA256) == 0 {
+		return config, nil
+	}
+	pins := make([]Fingerprint, 0, len(opts.PinnedSHA256))
+	for _, s := range opts.PinnedSHA256 {
+		fp, err := ParseFingerprint(s)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, fp)
+	}
+	// The pin replaces chain verification, but not the handshake, which
+	// proves that the controller holds the pinned key
+	config.InsecureSkipVerify = opts.CAFile == ""
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("controller presented no certificate")
+		}
+		return checkPins(state.PeerCertificates[0], pins)
+	}
+	return config, nil
+}
+
+// checkPins returns an error unless the leaf certificate matches one of pins by
+// certificate or SPKI fingerprint. Only the leaf is checked: without chain
+// verification, a presented intermediate proves nothing.
+func checkPins(leaf *x509.Certificate, pins []Fingerprint) error {
+	cert, spki := CertificateFingerprint(leaf), SPKIFingerprint(leaf)
+	for _, pin := range pins {
+		if pin == cert || pin == spki {
+			return nil
+		}
+	}
+	return fmt.Errorf("controller certificate matches no pinned fingerprint (certificate %s, SPKI %s)", cert, spki)
+}
+
+// FetchCertificates connects to the controller at baseURL through the proxy
+// and with the client certificate of opts, and returns the certificate chain
+// it presents, leaf first, without verifying it
+func FetchCertificates(ctx context.Context, baseURL string, opts ClientOptions) ([]*x509.Certificate, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse controller URL: %w", err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("controller URL %s does not use https", baseURL)
+	}
+
+	opts.InsecureSkipVerify, opts.CAFile, opts.PinnedSHA256 = true, "", nil
+	transport, err := newTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer transport.CloseIdleConnections()
+	var certs []*x509.Certificate
+	transport.TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		certs = state.PeerCertificates
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, baseURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	// A client certificate rejected after the handshake still leaves the
+	// controller's certificate
+	if len(certs) == 0 {
+		if err == nil {
+			err = errors.New("no certificate presented")
+		}
+		return nil, fmt.Errorf("connect to %s: %w", u.Host, err)
+	}
+	return certs, nil
+}
@@ -0,0 +1,126 @@
+package unifi
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tlsServer returns a TLS test server with a self-signed certificate that
+// answers every request with an empty JSON object
+func tlsServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestParseFingerprint(t *testing.T) {
+	t.Parallel()
+
+	want := strings.Repeat("ab", 32)
+	for _, input := range []string{want, strings.ToUpper(want), " " + strings.Repeat("AB:", 31) + "AB "} {
+		fp, err := ParseFingerprint(input)
+		if err != nil {
+			t.Errorf("ParseFingerprint(%q) error = %v", input, err)
+			continue
+		}
+		if got := strings.ReplaceAll(fp.String(), ":", ""); got != strings.ToUpper(want) {
+			t.Errorf("ParseFingerprint(%q) = %s", input, fp)
+		}
+	}
+	for _, input := range []string{"", "abcd", strings.Repeat("zz", 32), strings.Repeat("ab", 33)} {
+		if _, err := ParseFingerprint(input); err == nil {
+			t.Errorf("ParseFingerprint(%q) expected error", input)
+		}
+	}
+}
+
+func TestClientPinsControllerCertificate(t *testing.T) {
+	t.Parallel()
+
+	server := tlsServer(t)
+	leaf := server.Certificate()
+
+	tests := map[string]struct {
+		pins    []string
+		wantErr bool
+	}{
+		"no pin":          {wantErr: true},
+		"certificate pin": {pins: []string{CertificateFingerprint(leaf).String()}},
+		"spki pin":        {pins: []string{strings.Repeat("00", 32), SPKIFingerprint(leaf).String()}},
+		"mismatching pin": {pins: []string{strings.Repeat("00", 32)}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			client, err := NewClient(server.URL, ClientOptions{PinnedSHA256: tt.pins})
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			err = client.Ping(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Ping() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientTrustsCAFile(t *testing.T) {
+	t.Parallel()
+
+	server := tlsServer(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(server.URL, ClientOptions{CAFile: caFile})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := client.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() with CA file error = %v", err)
+	}
+
+	// The CA file and a pin must both match
+	pinned, _ := NewClient(server.URL, ClientOptions{CAFile: caFile, PinnedSHA256: []string{strings.Repeat("00", 32)}})
+	if err := pinned.Ping(context.Background()); err == nil {
+		t.Error("expected Ping() to fail for a mismatching pin")
+	}
+
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewClient(server.URL, ClientOptions{CAFile: empty}); err == nil {
+		t.Error("expected NewClient() to reject a CA file without certificates")
+	}
+}
+
+func TestFetchCertificates(t *testing.T) {
+	t.Parallel()
+
+	server := tlsServer(t)
+	certs, err := FetchCertificates(context.Background(), server.URL, ClientOptions{})
+	if err != nil {
+		t.Fatalf("FetchCertificates() error = %v", err)
+	}
+	if CertificateFingerprint(certs[0]) != CertificateFingerprint(server.Certificate()) {
+		t.Error("FetchCertificates() returned another certificate")
+	}
+	if _, err := FetchCertificates(context.Background(), "http://unifi.local", ClientOptions{}); err == nil {
+		t.Error("expected error for a plain HTTP URL")
+	}
+}
@@ -0,0 +1,64 @@
+package unifi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Proxy values that do not name a proxy URL
+const (
+	// ProxyEnvironment uses the HTTPS_PROXY and NO_PROXY environment
+	// variables, like an empty Proxy option
+	ProxyEnvironment = "environment"
+	// ProxyDirect connects to the controller without a proxy, even when
+	// HTTPS_PROXY is set
+	ProxyDirect = "direct"
+)
+
+// newTransport returns the HTTP transport for controller connections, with
+// the TLS and proxy settings of opts
+func newTransport(opts ClientOptions) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := ParseProxy(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{
+		Proxy:           proxy,
+		TLSClientConfig: tlsConfig,
+	}, nil
+}
+
+// ParseProxy returns the proxy selection of http.Transport for a Proxy
+// option: empty or "environment" for the environment variables, "direct" for
+// no proxy, or the URL of an HTTP CONNECT (http, https) or SOCKS5 (socks5,
+// socks5h) proxy, optionally with credentials.
+func ParseProxy(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch strings.ToLower(proxy) {
+	case "", ProxyEnvironment:
+		return http.ProxyFromEnvironment, nil
+	case ProxyDirect:
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		// url.Error would include the credentials
+		return nil, errors.New("invalid proxy URL")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q: use http, https, socks5 or socks5h", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %s has no host", u.Redacted())
+	}
+	return http.ProxyURL(u), nil
+}
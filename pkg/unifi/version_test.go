@@ -0,0 +1,32 @@
+package unifi
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"9.0.114", "9.0.114", 0},
+		{"9.0.114", "9.0.108", 1},
+		{"8.6.9", "9.0.114", -1},
+		{"9.0", "9.0.0", 0},
+		{"9.1.0", "9.0.114", 1},
+		{"v9.0.114-beta", "9.0.114", 0},
+		{"10.0.1", "9.5.21", 1},
+	}
+	for _, tt := range tests {
+		got, err := CompareVersions(tt.a, tt.b)
+		if err != nil || got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, %v, want %d", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"", "latest", "9..1"} {
+		if _, err := CompareVersions(invalid, "9.0.114"); err == nil {
+			t.Errorf("CompareVersions(%q) expected error", invalid)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/config"
+	"github.com/ConnorsApps/unifi-backup/pkg/storage"
+)
+
+// runReindex implements the reindex subcommand, which rebuilds the catalog
+// of each store from a full listing
+func runReindex(args []string) int {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML or JSON)")
+	storageFlag := fs.String("storage", "", "Storage URL or storage target name (defaults to all configured targets)")
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	cfg.SetupLogger()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exitCode := 0
+	for _, target := range selectStorageTargets(cfg, *storageFlag) {
+		store, err := storage.Open(ctx, target.URL)
+		if err != nil {
+			slog.Error("Error opening storage", "target", target.Name, "error", err)
+			exitCode = 1
+			continue
+		}
+
+		slog.Info("Rebuilding catalog", "target", target.Name)
+		catalog, err := storage.RebuildCatalog(ctx, store)
+		store.Close()
+		if err != nil {
+			slog.Error("Failed to rebuild catalog", "target", target.Name, "error", err)
+			exitCode = 1
+			continue
+		}
+
+		withManifest := 0
+		for _, entry := range catalog.Backups {
+			if entry.Manifest != nil {
+				withManifest++
+			}
+		}
+		slog.Info("Catalog rebuilt",
+			"target", target.Name,
+			"backups", len(catalog.Backups),
+			"with_manifest", withManifest,
+			"orphaned_manifests", len(catalog.OrphanedManifests),
+		)
+	}
+
+	return exitCode
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/backoff"
+	"github.com/ConnorsApps/unifi-backup/pkg/config"
+)
+
+// controllerStatus is a single row of the status subcommand output
+type controllerStatus struct {
+	Controller string                `json:"controller"`
+	Breaker    backoff.BreakerStatus `json:"breaker"`
+	backoff.BreakerState
+}
+
+// runStatus implements the status subcommand, which prints the circuit
+// breaker state of every controller in the breaker state file
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML or JSON)")
+	format := fs.String("format", "table", "Output format: table or json")
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	cfg.SetupLoggerTo(os.Stderr)
+
+	write, ok := statusWriters[strings.ToLower(*format)]
+	if !ok {
+		slog.Error("Invalid output format", "format", *format)
+		return 2
+	}
+
+	if cfg.Breaker.Threshold <= 0 {
+		slog.Warn("Circuit breaker is disabled; set breaker.threshold to enable it")
+	}
+	states, err := backoff.LoadBreakerStates(cfg.Breaker.StateFile)
+	if err != nil {
+		slog.Error("Failed to load circuit breaker state", "error", err)
+		return 1
+	}
+	coolDown, _ := time.ParseDuration(cfg.Breaker.CoolDown)
+
+	// Always show the configured controller, even before its first failure
+	if _, ok := states[breakerKey(cfg)]; !ok {
+		states[breakerKey(cfg)] = backoff.BreakerState{}
+	}
+
+	rows := make([]controllerStatus, 0, len(states))
+	for controller, state := range states {
+		breaker := backoff.Breaker{Threshold: cfg.Breaker.Threshold, CoolDown: coolDown, State: state}
+		rows = append(rows, controllerStatus{
+			Controller:   controller,
+			Breaker:      breaker.Status(),
+			BreakerState: state,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Controller < rows[j].Controller })
+
+	if err := write(os.Stdout, rows, time.Now()); err != nil {
+		slog.Error("Failed to write status", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// statusWriters maps the -format values of the status subcommand to their
+// writers
+var statusWriters = map[string]func(w io.Writer, rows []controllerStatus, now time.Time) error{
+	"table": writeStatusTable,
+	"json":  writeStatusJSON,
+}
+
+func writeStatusTable(w io.Writer, rows []controllerStatus, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTROLLER\tBREAKER\tFAILURES\tLAST SUCCESS\tOPEN UNTIL\tLAST ERROR")
+	for _, row := range rows {
+		lastSuccess, openUntil := "-", "-"
+		if !row.LastSuccess.IsZero() {
+			lastSuccess = row.LastSuccess.UTC().Format(time.RFC3339)
+		}
+		if row.Breaker == backoff.BreakerOpen {
+			openUntil = fmt.Sprintf("%s (in %s)", row.OpenUntil.UTC().Format(time.RFC3339), formatAge(row.OpenUntil.Sub(now)))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			row.Controller, row.Breaker, row.Failures, lastSuccess, openUntil, valueOrDash(row.LastError))
+	}
+	return tw.Flush()
+}
+
+func writeStatusJSON(w io.Writer, rows []controllerStatus, _ time.Time) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
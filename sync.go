@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/config"
+	"github.com/ConnorsApps/unifi-backup/pkg/storage"
+)
+
+// runSync implements the sync subcommand, which copies backups between two
+// object stores
+func runSync(args []string) int {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML or JSON)")
+	from := fs.String("from", "", "Source storage URL or storage target name")
+	to := fs.String("to", "", "Destination storage URL or storage target name")
+	concurrency := fs.Int("concurrency", 4, "Number of backups to copy in parallel")
+	deleteExtra := fs.Bool("delete", false, "Delete backups from the destination that do not exist in the source")
+	verify := fs.Bool("verify", false, "Read each copy back and compare its SHA-256 checksum with the source")
+	dryRun := fs.Bool("dry-run", false, "Log planned actions without copying or deleting")
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	cfg.SetupLogger()
+
+	if *from == "" || *to == "" {
+		slog.Error("Both -from and -to are required")
+		fs.Usage()
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	layout, err := cfg.KeyLayout()
+	if err != nil {
+		slog.Error("Invalid storage key template", "error", err)
+		return 1
+	}
+
+	src, err := storage.Open(ctx, resolveStorageURL(cfg, *from))
+	if err != nil {
+		slog.Error("Error opening source storage", "error", err)
+		return 1
+	}
+	defer src.Close()
+
+	dst, err := storage.Open(ctx, resolveStorageURL(cfg, *to))
+	if err != nil {
+		slog.Error("Error opening destination storage", "error", err)
+		return 1
+	}
+	defer dst.Close()
+
+	slog.Info("Starting sync",
+		"concurrency", *concurrency,
+		"delete", *deleteExtra,
+		"verify", *verify,
+		"dry_run", *dryRun,
+	)
+
+	result, err := storage.Sync(ctx, src, dst, storage.SyncOptions{
+		Concurrency: *concurrency,
+		Delete:      *deleteExtra,
+		Verify:      *verify,
+		DryRun:      *dryRun,
+		Layout:      layout,
+	})
+	if err != nil {
+		slog.Error("Sync failed", "error", err)
+		return 1
+	}
+
+	slog.Info("Sync completed",
+		"copied", result.Copied,
+		"skipped", result.Skipped,
+		"deleted", result.Deleted,
+		"failed", result.Failed,
+		"bytes_copied", storage.FormatBytes(result.BytesCopied),
+	)
+	// Copies bypass the destination catalog, so rebuild it
+	if catalogMaxAge, _ := cfg.CatalogMaxAge(); catalogMaxAge > 0 && !*dryRun && result.Copied+result.Deleted > 0 {
+		if _, err := storage.RebuildCatalog(ctx, dst); err != nil {
+			slog.Warn("Failed to rebuild destination catalog", "error", err)
+		}
+	}
+
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// resolveStorageURL returns the URL of the storage target with the given
+// name, or the value itself when no target matches
+func resolveStorageURL(cfg *config.Config, nameOrURL string) string {
+	for _, target := range cfg.StorageTargets() {
+		if target.Name == nameOrURL {
+			return target.URL
+		}
+	}
+	return nameOrURL
+}
+
+// selectStorageTargets returns the storage target with the given name, an
+// ad-hoc target for a storage URL, or all configured targets when nameOrURL
+// is empty
+func selectStorageTargets(cfg *config.Config, nameOrURL string) []config.StorageTarget {
+	if nameOrURL == "" {
+		return cfg.StorageTargets()
+	}
+	for _, target := range cfg.StorageTargets() {
+		if target.Name == nameOrURL {
+			return []config.StorageTarget{target}
+		}
+	}
+
+	name := nameOrURL
+	if u, err := url.Parse(name); err == nil {
+		// Keep passwords in ad-hoc URLs out of the logs
+		name = u.Redacted()
+	}
+	keepLast := cfg.Retention.KeepLast
+	return []config.StorageTarget{{Name: name, URL: nameOrURL, KeepLast: &keepLast, Policy: config.TargetPolicyRequired}}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/config"
+	"github.com/ConnorsApps/unifi-backup/pkg/unifi"
+)
+
+// runTrust implements the trust subcommand, which fetches the certificate
+// chain of a controller and prints the fingerprints to pin in
+// unifi.pinnedSHA256
+func runTrust(args []string) int {
+	fs := flag.NewFlagSet("trust", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML or JSON)")
+	controllerURL := fs.String("url", "", "Controller URL (defaults to unifi.url from the configuration)")
+	proxy := fs.String("proxy", "", `Proxy URL, "environment" or "direct" (defaults to unifi.proxy from the configuration)`)
+	_ = fs.Parse(args)
+
+	// Connect like the backup would, unless another console is given
+	var opts unifi.ClientOptions
+	if *controllerURL == "" {
+		cfg, err := config.LoadConfig(*configPath)
+		if err != nil {
+			slog.Error("Failed to load configuration", "error", err)
+			return 1
+		}
+		cfg.SetupLoggerTo(os.Stderr)
+		*controllerURL = cfg.UniFi.URL
+		opts = unifi.ClientOptions{
+			ClientCertFile: cfg.UniFi.ClientCertFile,
+			ClientKeyFile:  cfg.UniFi.ClientKeyFile,
+			Proxy:          cfg.UniFi.Proxy,
+		}
+	}
+	if *proxy != "" {
+		opts.Proxy = *proxy
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	certs, err := unifi.FetchCertificates(ctx, *controllerURL, opts)
+	if err != nil {
+		slog.Error("Failed to fetch controller certificate", "error", err)
+		return 1
+	}
+	writeTrust(os.Stdout, *controllerURL, certs)
+	return 0
+}
+
+// writeTrust prints the certificate chain with its fingerprints, whether the
+// system roots already trust it, and the configuration that pins the leaf
+func writeTrust(w io.Writer, controllerURL string, certs []*x509.Certificate) {
+	for i, cert := range certs {
+		role := "intermediate"
+		if i == 0 {
+			role = "leaf"
+		}
+		fmt.Fprintf(w, "Certificate %d (%s)\n", i, role)
+		fmt.Fprintf(w, "  Subject:      %s\n", cert.Subject)
+		fmt.Fprintf(w, "  Issuer:       %s\n", cert.Issuer)
+		if names := certificateNames(cert); len(names) > 0 {
+			fmt.Fprintf(w, "  Names:        %s\n", strings.Join(names, ", "))
+		}
+		fmt.Fprintf(w, "  Valid:        %s to %s\n", cert.NotBefore.UTC().Format(time.DateOnly), cert.NotAfter.UTC().Format(time.DateOnly))
+		fmt.Fprintf(w, "  SHA-256:      %s\n", unifi.CertificateFingerprint(cert))
+		fmt.Fprintf(w, "  SPKI SHA-256: %s\n", unifi.SPKIFingerprint(cert))
+		fmt.Fprintln(w)
+	}
+
+	if err := verifySystemTrust(controllerURL, certs); err != nil {
+		fmt.Fprintf(w, "The system roots do not trust this certificate: %v\n", err)
+	} else {
+		fmt.Fprintln(w, "The system roots already trust this certificate; no pin is needed.")
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "To pin the console's key, which survives certificate renewals that keep it, add:")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "unifi:")
+	fmt.Fprintln(w, "  pinnedSHA256:")
+	fmt.Fprintf(w, "    - %q\n", unifi.SPKIFingerprint(certs[0]).String())
+}
+
+// certificateNames returns the DNS names and IP addresses a certificate is
+// valid for
+func certificateNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// verifySystemTrust verifies the chain against the system roots for the
+// controller's host name
+func verifySystemTrust(controllerURL string, certs []*x509.Certificate) error {
+	u, err := url.Parse(controllerURL)
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{DNSName: u.Hostname(), Intermediates: intermediates})
+	return err
+}
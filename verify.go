@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ConnorsApps/unifi-backup/pkg/config"
+	"github.com/ConnorsApps/unifi-backup/pkg/storage"
+	"github.com/ConnorsApps/unifi-backup/pkg/unifi"
+)
+
+// runVerify implements the verify subcommand, which test-restores stored
+// backups and records the result in their manifests
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML or JSON)")
+	storageFlag := fs.String("storage", "", "Storage URL or storage target name (defaults to all configured targets)")
+	key := fs.String("key", "", "Key of the backup to verify (defaults to the latest backup of the configured controller and site)")
+	all := fs.Bool("all", false, "Verify every backup of the configured controller and site")
+	version := fs.String("version", "", "Expected UniFi Network version (defaults to the version recorded in the manifest)")
+	_ = fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	cfg.SetupLogger()
+
+	if *key != "" && *all {
+		slog.Error("-key cannot be combined with -all")
+		return 2
+	}
+	layout, err := cfg.KeyLayout()
+	if err != nil {
+		slog.Error("Invalid storage key template", "error", err)
+		return 1
+	}
+	catalogMaxAge, _ := cfg.CatalogMaxAge()
+	current := backupKeyData(cfg, time.Now())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exitCode := 0
+	for _, target := range selectStorageTargets(cfg, *storageFlag) {
+		store, err := storage.Open(ctx, target.URL)
+		if err != nil {
+			slog.Error("Error opening storage", "target", target.Name, "error", err)
+			exitCode = 1
+			continue
+		}
+
+		keys := []string{*key}
+		if *key == "" {
+			catalog, err := storage.LoadCatalog(ctx, store, catalogMaxAge)
+			if err != nil {
+				slog.Error("Failed to list backups", "target", target.Name, "error", err)
+				store.Close()
+				exitCode = 1
+				continue
+			}
+			keys = keys[:0]
+			for _, backup := range retentionBackups(catalog, layout, current) {
+				keys = append(keys, backup.filename)
+				if !*all {
+					break
+				}
+			}
+			if len(keys) == 0 {
+				slog.Warn("No backups to verify", "target", target.Name)
+			}
+		}
+
+		passed, failed := 0, 0
+		for _, k := range keys {
+			manifest, err := verifyBackup(ctx, store, k, *version)
+			if catalogMaxAge > 0 && manifest != nil {
+				if err := storage.UpdateCatalog(ctx, store, func(c *storage.Catalog) { c.SetManifest(manifest) }); err != nil {
+					slog.Warn("Failed to update catalog", "target", target.Name, "error", err)
+				}
+			}
+			if err != nil {
+				slog.Error("Backup verification failed", "target", target.Name, "key", k, "error", err)
+				failed++
+				exitCode = 1
+				continue
+			}
+			passed++
+		}
+		store.Close()
+
+		slog.Info("Verification completed", "target", target.Name, "passed", passed, "failed", failed)
+	}
+	return exitCode
+}
+
+// verifyBackup reads the backup key back from store, checks it against its
+// manifest, decrypts and unpacks it and checks its database dump. When
+// version is empty, the version recorded in the manifest is expected.
+//
+// The result is recorded in the backup's manifest, which is returned so
+// the caller can update the catalog. Backups without a manifest are
+// verified but the result is not recorded, and the returned manifest is nil.
+func verifyBackup(ctx context.Context, store storage.ObjectStore, key, version string) (*storage.Manifest, error) {
+	manifest, err := storage.ReadManifest(ctx, store, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		slog.Warn("Backup has no manifest; the verification result is not recorded", "key", key)
+		manifest = nil
+	} else if err != nil {
+		return nil, err
+	}
+	if version == "" && manifest != nil {
+		version = manifest.Version
+	}
+
+	slog.Info("Verifying backup", "key", key)
+	verifyErr := checkStoredBackup(ctx, store, key, manifest, version)
+	if manifest == nil {
+		return nil, verifyErr
+	}
+
+	manifest.Verification = &storage.Verification{VerifiedAt: time.Now().UTC(), OK: verifyErr == nil}
+	if verifyErr != nil {
+		manifest.Verification.Error = verifyErr.Error()
+	}
+	if err := storage.WriteManifest(ctx, store, manifest); err != nil {
+		slog.Warn("Failed to record verification result", "key", key, "error", err)
+	}
+	if verifyErr == nil {
+		slog.Info("Backup verified", "key", key)
+	}
+	return manifest, verifyErr
+}
+
+// checkStoredBackup performs the checks of verifyBackup
+func checkStoredBackup(ctx context.Context, store storage.ObjectStore, key string, manifest *storage.Manifest, version string) error {
+	reader, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	counter := &countingReader{r: io.TeeReader(reader, hash)}
+	contents, err := unifi.InspectBackup(counter)
+	if err != nil {
+		return err
+	}
+	// Consume any trailing bytes so the checksum covers the whole object
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return fmt.Errorf("read %q: %w", key, err)
+	}
+
+	if manifest != nil {
+		checksum := hex.EncodeToString(hash.Sum(nil))
+		if manifest.Size > 0 && counter.n != manifest.Size {
+			return fmt.Errorf("size mismatch: manifest records %d bytes, read %d", manifest.Size, counter.n)
+		}
+		if manifest.SHA256 != "" && !strings.EqualFold(checksum, manifest.SHA256) {
+			return fmt.Errorf("checksum mismatch: manifest records %s, read %s", manifest.SHA256, checksum)
+		}
+	}
+
+	slog.Debug("Backup contents", "key", key, "version", contents.Version, "collections", len(contents.Collections))
+	return contents.Check(version)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}